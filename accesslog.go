@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Where access records go, the proxy.accessLog.output setting
+	ACCESS_LOG_STDOUT = "stdout"
+	ACCESS_LOG_FILE   = "file"
+	ACCESS_LOG_SYSLOG = "syslog"
+
+	// Record encodings, the proxy.accessLog.format setting
+	ACCESS_LOG_JSON   = "json"
+	ACCESS_LOG_LOGFMT = "logfmt"
+
+	// Defaults of the access log file and its rotation
+	ACCESS_LOG_DEFAULT_FILE   = "log/access.log"
+	ACCESS_LOG_MAX_SIZE       = 100 * 1024 * 1024
+	ACCESS_LOG_ROTATE_EVERY   = 24 * time.Hour
+	ACCESS_LOG_MAX_BACKUPS    = 7
+	ACCESS_LOG_SYSLOG_TAG     = "proxy-server"
+	ACCESS_LOG_BACKUP_SUFFIX  = "20060102-150405.000000"
+	ACCESS_LOG_FILE_MODE      = 0640
+	ACCESS_LOG_DIRECTORY_MODE = 0750
+
+	// How long a file that could not be rotated is written to before the
+	// rotation is tried again
+	ACCESS_LOG_ROTATE_RETRY = time.Minute
+)
+
+// AccessLogConfig describes the access log, which gets one record per tunnel
+// when it closes. It is separate from the application log.
+type AccessLogConfig struct {
+	Output      string        `yaml:"output"`      // stdout, file or syslog, empty to disable the access log
+	Format      string        `yaml:"format"`      // json or logfmt
+	File        string        `yaml:"file"`        // Path of the log file when Output is file
+	MaxSize     int64         `yaml:"maxSize"`     // Bytes after which the file is rotated, 0 for no limit
+	RotateEvery time.Duration `yaml:"rotateEvery"` // Age after which the file is rotated, 0 for no limit
+	MaxBackups  int           `yaml:"maxBackups"`  // Rotated files kept, 0 to keep them all
+	Syslog      string        `yaml:"syslog"`      // Syslog server as udp://host:port or tcp://host:port, empty for the local daemon
+	SyslogTag   string        `yaml:"syslogTag"`
+}
+
+// validate checks the access log settings, reporting problems through invalid
+func (c *AccessLogConfig) validate(invalid func(name, format string, args ...any)) {
+	switch c.Output {
+	case "", ACCESS_LOG_STDOUT, ACCESS_LOG_SYSLOG:
+	case ACCESS_LOG_FILE:
+		if c.File == "" {
+			invalid("proxy.accessLog.file", "must not be empty when output is %s", ACCESS_LOG_FILE)
+		}
+	default:
+		invalid("proxy.accessLog.output", "must be %s, %s or %s, got %q",
+			ACCESS_LOG_STDOUT, ACCESS_LOG_FILE, ACCESS_LOG_SYSLOG, c.Output)
+	}
+	if c.Format != ACCESS_LOG_JSON && c.Format != ACCESS_LOG_LOGFMT {
+		invalid("proxy.accessLog.format", "must be %s or %s, got %q", ACCESS_LOG_JSON, ACCESS_LOG_LOGFMT, c.Format)
+	}
+	if c.MaxSize < 0 {
+		invalid("proxy.accessLog.maxSize", "must not be negative, got %d", c.MaxSize)
+	}
+	if c.RotateEvery < 0 {
+		invalid("proxy.accessLog.rotateEvery", "must not be negative, got %s", c.RotateEvery)
+	}
+	if c.MaxBackups < 0 {
+		invalid("proxy.accessLog.maxBackups", "must not be negative, got %d", c.MaxBackups)
+	}
+	if _, _, err := parseSyslogAddress(c.Syslog); err != nil {
+		invalid("proxy.accessLog.syslog", "%v", err)
+	}
+}
+
+// parseSyslogAddress splits a udp:// or tcp:// syslog server URL into the
+// arguments of syslog.Dial. An empty address is the local daemon.
+func parseSyslogAddress(raw string) (network, address string, err error) {
+	if raw == "" {
+		return "", "", nil
+	}
+	network, address, ok := strings.Cut(raw, "://")
+	if !ok || (network != "udp" && network != "tcp") || address == "" {
+		return "", "", fmt.Errorf("invalid syslog server %q, expected udp://host:port or tcp://host:port", raw)
+	}
+	return network, address, nil
+}
+
+// accessLog writes one record per finished tunnel. A nil accessLog is
+// disabled and drops every record.
+type accessLog struct {
+	handler slog.Handler
+	closer  io.Closer // The file or syslog connection, nil for stdout
+}
+
+// openAccessLog opens the sink described by cfg, or returns nil when the
+// access log is disabled
+func openAccessLog(cfg AccessLogConfig) (*accessLog, error) {
+	var w io.Writer
+	var closer io.Closer
+	switch cfg.Output {
+	case "":
+		return nil, nil
+	case ACCESS_LOG_STDOUT:
+		w = os.Stdout
+	case ACCESS_LOG_FILE:
+		file, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.RotateEvery, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = file, file
+	case ACCESS_LOG_SYSLOG:
+		network, address, err := parseSyslogAddress(cfg.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, cfg.SyslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		w, closer = writer, writer
+	default:
+		return nil, fmt.Errorf("unknown access log output %q", cfg.Output)
+	}
+
+	// Every record is an access record, so level and message are left out
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && (attr.Key == slog.LevelKey || attr.Key == slog.MessageKey) {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}
+	var handler slog.Handler
+	if cfg.Format == ACCESS_LOG_LOGFMT {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return &accessLog{handler: handler, closer: closer}, nil
+}
+
+// Record writes the access record of a finished session, timestamped with
+// the time it ended
+func (a *accessLog) Record(session *Session) {
+	if a == nil {
+		return
+	}
+
+	record := slog.NewRecord(session.EndedAt, slog.LevelInfo, "", 0)
+	record.AddAttrs(
+		slog.String("username", session.Username),
+		slog.String("client", session.ClientAddr),
+		slog.String("host", session.Host),
+		slog.Int("port", session.Port),
+		slog.String("resolvedIP", session.ResolvedIP),
+		slog.Int64("durationMs", session.EndedAt.Sub(session.StartedAt).Milliseconds()),
+		slog.Int64("bytesUp", session.BytesUp),
+		slog.Int64("bytesDown", session.BytesDown),
+		slog.Int("replyCode", int(session.ReplyCode)),
+		slog.String("closeReason", session.CloseReason),
+	)
+	a.handler.Handle(context.Background(), record)
+}
+
+// Close flushes and closes the sink
+func (a *accessLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// rotatingFile is an append-only log file that is renamed with a timestamp
+// suffix and replaced by a new one once it reaches maxSize bytes or gets
+// older than interval. Only the newest maxBackups rotated files are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mutex        sync.Mutex
+	file         *os.File // nil after Close, or when it could not be reopened
+	closed       bool
+	size         int64
+	opened       time.Time // Start of the file's interval, rotated once it is over
+	rotateFailed time.Time // Last failed rotation, retried after ACCESS_LOG_ROTATE_RETRY
+}
+
+// openRotatingFile opens path for appending, creating it and its directory
+// if needed
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), ACCESS_LOG_DIRECTORY_MODE); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %v", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file. An existing file keeps counting its interval
+// from when it was last written.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, ACCESS_LOG_FILE_MODE)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	if f.size > 0 {
+		f.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends one record, rotating the file first when it is due. A failed
+// rotation does not lose the record, it is written to the current file.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file != nil && f.due(len(b)) {
+		f.rotate()
+	}
+	// Retry a file that could not be reopened after a rotation
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must be rotated before n more bytes are
+// written. An empty file is never rotated.
+func (f *rotatingFile) due(n int) bool {
+	if f.size == 0 || time.Since(f.rotateFailed) < ACCESS_LOG_ROTATE_RETRY {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.opened) >= f.interval
+}
+
+// rotate renames the current file and opens a new one. Failures are logged:
+// a file that could not be renamed is reopened and kept until the rotation
+// is retried, and one that could not be reopened is retried by the next
+// Write. The caller must hold mutex.
+func (f *rotatingFile) rotate() {
+	if err := f.file.Close(); err != nil {
+		slog.Warn("Failed to close access log", "file", f.path, "error", err)
+	}
+	f.file = nil
+
+	backup := f.path + "." + time.Now().Format(ACCESS_LOG_BACKUP_SUFFIX)
+	renameErr := os.Rename(f.path, backup)
+	if renameErr != nil {
+		slog.Warn("Failed to rotate access log, keeping the current file", "file", f.path, "error", renameErr)
+		f.rotateFailed = time.Now()
+	}
+
+	if err := f.open(); err != nil {
+		slog.Error("Failed to reopen access log", "file", f.path, "error", err)
+		return
+	}
+	f.opened = time.Now()
+	if renameErr == nil {
+		f.prune()
+	}
+}
+
+// prune removes the oldest rotated files beyond maxBackups. Failures are
+// ignored, the files are retried at the next rotation.
+func (f *rotatingFile) prune() {
+	if f.maxBackups == 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(backups) <= f.maxBackups {
+		return
+	}
+	// The timestamp suffix sorts oldest first
+	slices.Sort(backups)
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		os.Remove(backup)
+	}
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
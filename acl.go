@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Rule actions stored in aclRule.action
+	ACL_ALLOW = "allow"
+	ACL_DENY  = "deny"
+
+	// Rule scopes stored in aclRule.scope
+	ACL_SCOPE_GLOBAL = "global"
+	ACL_SCOPE_USER   = "user"
+	ACL_SCOPE_GROUP  = "group"
+
+	// How often the rules are reloaded from the database
+	ACL_RELOAD_INTERVAL = 30 * time.Second
+)
+
+// ErrDestinationDenied is returned when an ACL rule denies a destination
+var ErrDestinationDenied = errors.New("destination denied by access rule")
+
+// ACLRule is one row of the aclRule table
+type ACLRule struct {
+	ID          int64
+	Priority    int
+	Scope       string // ACL_SCOPE_GLOBAL, ACL_SCOPE_USER or ACL_SCOPE_GROUP
+	Subject     string // Username or group name, empty for global rules
+	Action      string // ACL_ALLOW or ACL_DENY
+	Destination string // "*", CIDR, IP, exact domain or "*.domain"
+	PortFrom    int    // Inclusive port range, 0-65535 when not set
+	PortTo      int
+
+	network  *net.IPNet
+	domain   string
+	wildcard bool
+}
+
+// String identifies the rule in log entries
+func (r *ACLRule) String() string {
+	ports := "*"
+	if r.PortFrom != 0 || r.PortTo != 65535 {
+		ports = strconv.Itoa(r.PortFrom)
+		if r.PortTo != r.PortFrom {
+			ports += "-" + strconv.Itoa(r.PortTo)
+		}
+	}
+	return fmt.Sprintf("#%d %s %s %s:%s", r.ID, r.Scope, r.Action, r.Destination, ports)
+}
+
+// parseDestination fills in the matcher for r.Destination
+func (r *ACLRule) parseDestination() error {
+	dest := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(r.Destination), "."))
+	switch {
+	case dest == "" || dest == "*":
+		return nil
+	case strings.Contains(dest, "/"):
+		_, network, err := net.ParseCIDR(dest)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", r.Destination, err)
+		}
+		r.network = network
+	case net.ParseIP(dest) != nil:
+		ip := net.ParseIP(dest)
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(dest, "*."):
+		r.domain = dest[1:] // Keep the leading dot
+		r.wildcard = true
+	default:
+		r.domain = dest
+	}
+	return nil
+}
+
+// matches reports whether the rule covers a destination. Domain rules match
+// the requested host name, address rules match the host if it is an IP or
+// the addresses it resolved to. The dialer may use any of those addresses,
+// so a deny rule matches if one of them is in its network, while an allow
+// rule only matches if all of them are.
+func (r *ACLRule) matches(host string, ips []net.IP, port int) bool {
+	if port < r.PortFrom || port > r.PortTo {
+		return false
+	}
+
+	switch {
+	case r.network != nil:
+		if len(ips) == 0 {
+			return false
+		}
+		for _, ip := range ips {
+			if r.network.Contains(ip) != (r.Action == ACL_ALLOW) {
+				return r.Action != ACL_ALLOW
+			}
+		}
+		return r.Action == ACL_ALLOW
+	case r.domain != "":
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if r.wildcard {
+			return strings.HasSuffix(host, r.domain)
+		}
+		return host == r.domain
+	default:
+		return true
+	}
+}
+
+// aclSet is an immutable snapshot of the rules and group memberships
+type aclSet struct {
+	rules  []*ACLRule          // Ordered by priority, then id
+	groups map[string][]string // Maps username to group names
+}
+
+// appliesTo reports whether rule r is in effect for username
+func (set *aclSet) appliesTo(r *ACLRule, username string) bool {
+	switch r.Scope {
+	case ACL_SCOPE_GLOBAL:
+		return true
+	case ACL_SCOPE_USER:
+		return r.Subject == username
+	case ACL_SCOPE_GROUP:
+		for _, group := range set.groups[username] {
+			if group == r.Subject {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACL evaluates destination rules. Global, user and group rules form a single
+// list ordered by priority and the first rule that applies to the user and
+// matches the destination decides; when none does, the destination is
+// allowed. Rules are swapped atomically on reload, so in-flight checks always
+// see a consistent snapshot.
+type ACL struct {
+	current atomic.Pointer[aclSet]
+}
+
+// NewACL creates an ACL with no rules, which allows every destination
+func NewACL() *ACL {
+	acl := &ACL{}
+	acl.current.Store(&aclSet{})
+	return acl
+}
+
+// Load replaces the rules with the enabled rows of aclRule and the group
+// memberships in userGroup. On error the previous rules stay in effect.
+func (a *ACL) Load(db *sql.DB) error {
+	set := &aclSet{groups: make(map[string][]string)}
+
+	rows, err := db.Query("SELECT id, priority, scope, subject, action, destination, portFrom, portTo " +
+		"FROM aclRule WHERE enabled = 1 ORDER BY priority, id")
+	if err != nil {
+		return fmt.Errorf("failed to query ACL rules: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule ACLRule
+		var subject sql.NullString
+		var portFrom, portTo sql.NullInt64
+		if err := rows.Scan(&rule.ID, &rule.Priority, &rule.Scope, &subject, &rule.Action,
+			&rule.Destination, &portFrom, &portTo); err != nil {
+			return fmt.Errorf("failed to read ACL rule: %v", err)
+		}
+		rule.Subject = subject.String
+
+		if rule.Action != ACL_ALLOW && rule.Action != ACL_DENY {
+			return fmt.Errorf("ACL rule #%d: unknown action %q", rule.ID, rule.Action)
+		}
+		if rule.Scope != ACL_SCOPE_GLOBAL && rule.Scope != ACL_SCOPE_USER && rule.Scope != ACL_SCOPE_GROUP {
+			return fmt.Errorf("ACL rule #%d: unknown scope %q", rule.ID, rule.Scope)
+		}
+		if err := rule.parseDestination(); err != nil {
+			return fmt.Errorf("ACL rule #%d: %v", rule.ID, err)
+		}
+
+		// A missing bound leaves that side of the range open, a single
+		// portFrom matches exactly one port
+		rule.PortFrom, rule.PortTo = 0, 65535
+		if portFrom.Valid {
+			rule.PortFrom, rule.PortTo = int(portFrom.Int64), int(portFrom.Int64)
+		}
+		if portTo.Valid {
+			rule.PortTo = int(portTo.Int64)
+		}
+		if rule.PortFrom > rule.PortTo {
+			return fmt.Errorf("ACL rule #%d: invalid port range %d-%d", rule.ID, rule.PortFrom, rule.PortTo)
+		}
+
+		set.rules = append(set.rules, &rule)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read ACL rules: %v", err)
+	}
+
+	groupRows, err := db.Query("SELECT username, groupName FROM userGroup")
+	if err != nil {
+		return fmt.Errorf("failed to query user groups: %v", err)
+	}
+	defer groupRows.Close()
+
+	for groupRows.Next() {
+		var username, group string
+		if err := groupRows.Scan(&username, &group); err != nil {
+			return fmt.Errorf("failed to read user group: %v", err)
+		}
+		set.groups[username] = append(set.groups[username], group)
+	}
+	if err := groupRows.Err(); err != nil {
+		return fmt.Errorf("failed to read user groups: %v", err)
+	}
+
+	a.current.Store(set)
+	return nil
+}
+
+// Len returns the number of rules currently loaded
+func (a *ACL) Len() int {
+	return len(a.current.Load().rules)
+}
+
+// Check evaluates the rules for a user and destination. It returns whether
+// the destination is allowed and the rule that decided, or nil if no rule
+// matched.
+func (a *ACL) Check(username, host string, ips []net.IP, port int) (bool, *ACLRule) {
+	set := a.current.Load()
+	for _, rule := range set.rules {
+		if set.appliesTo(rule, username) && rule.matches(host, ips, port) {
+			return rule.Action == ACL_ALLOW, rule
+		}
+	}
+	return true, nil
+}
+
+// watchACL reloads the ACL from the database every ACL_RELOAD_INTERVAL so
+// rule changes take effect without a restart, until ctx is cancelled
+func (s *ProxyServer) watchACL(ctx context.Context) {
+	ticker := time.NewTicker(ACL_RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ACL.Load(s.DB); err != nil {
+				s.Logger.Error("Failed to reload ACL rules, keeping previous rules", "error", err)
+			}
+		}
+	}
+}
+
+// checkDestination applies the ACL to a destination about to be dialed on
+// behalf of user and logs the rule that denied it
+func (s *ProxyServer) checkDestination(user *User, host string, ips []net.IP, port int) error {
+	var username string
+	if user != nil {
+		username = user.Username
+	}
+
+	allowed, rule := s.ACL.Check(username, host, ips, port)
+	if allowed {
+		return nil
+	}
+
+	s.Logger.Warn("Destination denied by ACL", "username", username,
+		"destination", net.JoinHostPort(host, strconv.Itoa(port)), "rule", rule.String())
+	return fmt.Errorf("%w: %s", ErrDestinationDenied, rule)
+}
+
+// checkAddress resolves a host:port address the way the dialer would and
+// applies the ACL to it. Names are not resolved when a chain is configured,
+// so only domain rules apply to them.
+func (s *ProxyServer) checkAddress(rt *runtimeConfig, user *User, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if !rt.Dialer.UsesChain() {
+		// A failed lookup is reported by the dialer, not here
+		ips, _ = rt.Resolver.LookupIP(context.Background(), host)
+	}
+	return s.checkDestination(user, host, ips, port)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// parseIPs parses a list of IP addresses for a test table
+func parseIPs(addresses ...string) []net.IP {
+	ips := make([]net.IP, 0, len(addresses))
+	for _, address := range addresses {
+		ips = append(ips, net.ParseIP(address))
+	}
+	return ips
+}
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		network     string // Expected network, empty for none
+		domain      string
+		wildcard    bool
+		err         bool
+	}{
+		{destination: "*"},
+		{destination: ""},
+		{destination: "10.0.0.0/8", network: "10.0.0.0/8"},
+		{destination: "10.1.2.3/8", network: "10.0.0.0/8"},
+		{destination: "2001:db8::/32", network: "2001:db8::/32"},
+		{destination: "192.0.2.1", network: "192.0.2.1/32"},
+		{destination: "2001:db8::1", network: "2001:db8::1/128"},
+		{destination: "Example.COM.", domain: "example.com"},
+		{destination: " example.com ", domain: "example.com"},
+		{destination: "*.example.com", domain: ".example.com", wildcard: true},
+		{destination: "10.0.0.0/33", err: true},
+		{destination: "example.com/8", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			r := &ACLRule{Destination: tt.destination}
+			err := r.parseDestination()
+			if tt.err {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var network string
+			if r.network != nil {
+				network = r.network.String()
+			}
+			if network != tt.network || r.domain != tt.domain || r.wildcard != tt.wildcard {
+				t.Fatalf("got network %q domain %q wildcard %v, want %q %q %v",
+					network, r.domain, r.wildcard, tt.network, tt.domain, tt.wildcard)
+			}
+		})
+	}
+}
+
+func TestACLRuleMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		destination string
+		portFrom    int
+		portTo      int
+		host        string
+		ips         []net.IP
+		port        int
+		want        bool
+	}{
+		{name: "any", action: ACL_DENY, destination: "*", host: "example.com", port: 443, want: true},
+		{name: "exact domain", action: ACL_DENY, destination: "example.com", host: "example.com", port: 443, want: true},
+		{name: "exact domain is case insensitive", action: ACL_DENY, destination: "example.com", host: "EXAMPLE.com.", port: 443, want: true},
+		{name: "exact domain skips subdomain", action: ACL_DENY, destination: "example.com", host: "www.example.com", port: 443},
+		{name: "wildcard matches subdomain", action: ACL_DENY, destination: "*.example.com", host: "www.example.com", port: 443, want: true},
+		{name: "wildcard matches nested subdomain", action: ACL_DENY, destination: "*.example.com", host: "a.b.example.com", port: 443, want: true},
+		{name: "wildcard skips apex", action: ACL_DENY, destination: "*.example.com", host: "example.com", port: 443},
+		{name: "wildcard skips suffix without dot", action: ACL_DENY, destination: "*.example.com", host: "badexample.com", port: 443},
+		{name: "domain rule ignores ips", action: ACL_DENY, destination: "example.com", host: "192.0.2.1", ips: parseIPs("192.0.2.1"), port: 443},
+		{name: "ip", action: ACL_DENY, destination: "192.0.2.1", host: "192.0.2.1", ips: parseIPs("192.0.2.1"), port: 80, want: true},
+		{name: "ip rule without ips", action: ACL_DENY, destination: "192.0.2.1", host: "example.com", port: 80},
+		{name: "deny cidr matches any ip", action: ACL_DENY, destination: "10.0.0.0/8", host: "example.com", ips: parseIPs("192.0.2.1", "10.0.0.1"), port: 80, want: true},
+		{name: "deny cidr skips outside ips", action: ACL_DENY, destination: "10.0.0.0/8", host: "example.com", ips: parseIPs("192.0.2.1", "198.51.100.1"), port: 80},
+		{name: "allow cidr matches when every ip is inside", action: ACL_ALLOW, destination: "10.0.0.0/8", host: "example.com", ips: parseIPs("10.0.0.1", "10.1.0.1"), port: 80, want: true},
+		{name: "allow cidr skips when one ip is outside", action: ACL_ALLOW, destination: "10.0.0.0/8", host: "example.com", ips: parseIPs("10.0.0.1", "192.0.2.1"), port: 80},
+		{name: "allow cidr skips when no ip is inside", action: ACL_ALLOW, destination: "10.0.0.0/8", host: "example.com", ips: parseIPs("192.0.2.1"), port: 80},
+		{name: "allow cidr without ips", action: ACL_ALLOW, destination: "10.0.0.0/8", host: "example.com", port: 80},
+		{name: "ipv6 cidr", action: ACL_DENY, destination: "2001:db8::/32", host: "2001:db8::1", ips: parseIPs("2001:db8::1"), port: 80, want: true},
+		{name: "ipv4 cidr matches mapped address", action: ACL_DENY, destination: "10.0.0.0/8", host: "::ffff:10.0.0.1", ips: parseIPs("::ffff:10.0.0.1"), port: 80, want: true},
+		{name: "port in range", action: ACL_DENY, destination: "*", portFrom: 8000, portTo: 8080, host: "example.com", port: 8080, want: true},
+		{name: "port below range", action: ACL_DENY, destination: "*", portFrom: 8000, portTo: 8080, host: "example.com", port: 7999},
+		{name: "port above range", action: ACL_DENY, destination: "*", portFrom: 8000, portTo: 8080, host: "example.com", port: 8081},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ACLRule{Action: tt.action, Destination: tt.destination, PortFrom: tt.portFrom, PortTo: tt.portTo}
+			if r.PortTo == 0 {
+				r.PortTo = 65535
+			}
+			if err := r.parseDestination(); err != nil {
+				t.Fatalf("invalid destination: %v", err)
+			}
+			if got := r.matches(tt.host, tt.ips, tt.port); got != tt.want {
+				t.Fatalf("matches(%q, %v, %d) = %v, want %v", tt.host, tt.ips, tt.port, got, tt.want)
+			}
+		})
+	}
+}
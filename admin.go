@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Paths of the resources on the admin listener
+const (
+	ADMIN_BANS_PATH     = "/bans"
+	ADMIN_SESSIONS_PATH = "/sessions"
+)
+
+// serveAdmin binds the admin listener until ctx is cancelled. It has no
+// authentication of its own; the API server calls it on behalf of its
+// administrators.
+//
+//	GET    /bans                      current bans
+//	DELETE /bans                      lift every ban
+//	DELETE /bans?address=<ip>         lift the ban of an address
+//	DELETE /bans?username=<name>      lift the ban of a username
+//	GET    /sessions                  live sessions
+//	GET    /sessions?username=<name>  live sessions of a user
+//	DELETE /sessions/<id>             force-close a live session
+func (s *ProxyServer) serveAdmin(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ADMIN_BANS_PATH, s.handleListBans)
+	mux.HandleFunc("DELETE "+ADMIN_BANS_PATH, s.handleClearBans)
+	mux.HandleFunc("GET "+ADMIN_SESSIONS_PATH, s.handleListSessions)
+	mux.HandleFunc("DELETE "+ADMIN_SESSIONS_PATH+"/{id}", s.handleCloseSession)
+	return s.serveHTTP(ctx, "admin", address, mux)
+}
+
+// handleListBans writes the current bans
+func (s *ProxyServer) handleListBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"bans": s.bruteForce.List()})
+}
+
+// handleClearBans lifts one ban, or all of them without a query
+func (s *ProxyServer) handleClearBans(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	kind, key := BAN_ADDRESS, query.Get(BAN_ADDRESS)
+	if key == "" {
+		kind, key = BAN_USERNAME, query.Get(BAN_USERNAME)
+	}
+
+	if key == "" {
+		cleared := s.bruteForce.Clear()
+		s.Logger.Info("All bans lifted", "bans", cleared)
+		writeJSON(w, http.StatusOK, map[string]any{"cleared": cleared})
+		return
+	}
+	if !s.bruteForce.Unban(kind, key) {
+		writeJSON(w, http.StatusNotFound, map[string]any{"error": "ban not found"})
+		return
+	}
+	s.Logger.Info("Ban lifted", kind, key)
+	writeJSON(w, http.StatusOK, map[string]any{"cleared": 1})
+}
+
+// handleListSessions writes the live sessions, or those of one user with a
+// username query. total counts every live session either way.
+func (s *ProxyServer) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	var sessions []SessionInfo
+	if username := r.URL.Query().Get("username"); username != "" {
+		sessions = s.registry.ListUser(username)
+	} else {
+		sessions = s.registry.List()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"total": s.registry.Len(), "sessions": sessions})
+}
+
+// handleCloseSession force-closes the client connection of a live session
+func (s *ProxyServer) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid session id"})
+		return
+	}
+
+	if err := s.registry.Close(id); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": "session not found"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	s.Logger.Info("Session closed by administrator", "session", id)
+	writeJSON(w, http.StatusOK, map[string]any{"closed": id})
+}
+
+// writeJSON writes value as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
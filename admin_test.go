@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAdminSessions(t *testing.T) {
+	s := &ProxyServer{Logger: slog.New(slog.DiscardHandler), registry: NewSessionRegistry()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ADMIN_SESSIONS_PATH, s.handleListSessions)
+	mux.HandleFunc("DELETE "+ADMIN_SESSIONS_PATH+"/{id}", s.handleCloseSession)
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := s.registry.Register(conn, "main")
+	if err := s.registry.Authenticate(session, &User{Username: "alice", MaxConnection: 1}); err != nil {
+		t.Fatal(err)
+	}
+	other, otherPeer := net.Pipe()
+	defer otherPeer.Close()
+	s.registry.Register(other, "main")
+	id := strconv.FormatUint(session.ID, 10)
+
+	tests := []struct {
+		method   string
+		target   string
+		status   int
+		sessions int // Sessions listed by a GET
+	}{
+		{http.MethodGet, "/sessions", http.StatusOK, 2},
+		{http.MethodGet, "/sessions?username=alice", http.StatusOK, 1},
+		{http.MethodGet, "/sessions?username=bob", http.StatusOK, 0},
+		{http.MethodDelete, "/sessions/" + id, http.StatusOK, 0},
+		{http.MethodDelete, "/sessions/1000", http.StatusNotFound, 0},
+		{http.MethodDelete, "/sessions/abc", http.StatusBadRequest, 0},
+		{http.MethodDelete, "/sessions", http.StatusMethodNotAllowed, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.method != http.MethodGet {
+				return
+			}
+
+			var body struct {
+				Total    int           `json:"total"`
+				Sessions []SessionInfo `json:"sessions"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid body: %v", err)
+			}
+			if body.Total != 2 || len(body.Sessions) != tt.sessions {
+				t.Fatalf("got total %d and %d sessions, want 2 and %d", body.Total, len(body.Sessions), tt.sessions)
+			}
+		})
+	}
+
+	// The closed session's client sees its connection end
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("session connection still open after DELETE")
+	}
+}
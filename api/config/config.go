@@ -1,26 +1,254 @@
 package config
 
-// ServerPort là cổng mà API server sẽ lắng nghe
-const ServerPort = "8080"
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
 
-// DatabaseConfig chứa thông tin kết nối đến cơ sở dữ liệu
+// Biến môi trường chứa đường dẫn file cấu hình và tiền tố của các biến môi
+// trường ghi đè từng giá trị (tên flag viết hoa, ví dụ API_DB_HOST)
 const (
+	EnvConfigFile = "API_CONFIG"
+	EnvPrefix     = "API_"
+)
+
+// ServerPort là cổng mà API server sẽ lắng nghe
+var ServerPort = "8080"
+
+// DatabaseConfig chứa thông tin kết nối đến cơ sở dữ liệu.
+// Không có mật khẩu mặc định, mật khẩu phải được cấu hình khi chạy.
+var (
 	DBDriver   = "mysql"
 	DBUser     = "root"
-	DBPassword = "Tuan123"
+	DBPassword = ""
 	DBName     = "proxy"
 	DBHost     = "127.0.0.1"
 	DBPort     = "3306"
 )
 
 // JWTConfig chứa các cấu hình liên quan đến JWT
-const (
-	JWTSecret     = "Oegjsc1029384756" // Khóa bí mật để ký JWT
-	JWTExpiration = 24                        // Thời gian hết hạn của token (giờ)
+var (
+	JWTSecret     = "" // Khóa bí mật để ký JWT, bắt buộc phải cấu hình
+	JWTExpiration = 24 // Thời gian hết hạn của token (giờ)
 )
 
+// ProxyAdminURL là địa chỉ admin listener của proxy server (proxy.adminListen),
+// ví dụ http://127.0.0.1:9101. Để trống thì các API quản lý lệnh cấm bị tắt.
+var ProxyAdminURL = ""
+
 // AdminUsers là danh sách các tài khoản được phép sử dụng API
 var AdminUsers = []string{
 	"admin", // Tài khoản admin mặc định
-	// Thêm các tài khoản admin khác nếu cần
-}
\ No newline at end of file
+}
+
+// fileConfig là cấu trúc của file cấu hình YAML, dùng chung với proxy server
+type fileConfig struct {
+	Database struct {
+		Host         string `yaml:"host"`
+		Port         int    `yaml:"port"`
+		User         string `yaml:"user"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"passwordFile"`
+		Name         string `yaml:"name"`
+	} `yaml:"database"`
+	API struct {
+		Port          string   `yaml:"port"`
+		JWTSecret     string   `yaml:"jwtSecret"`
+		JWTSecretFile string   `yaml:"jwtSecretFile"`
+		JWTExpiration int      `yaml:"jwtExpiration"` // Giờ
+		AdminUsers    []string `yaml:"adminUsers"`
+		ProxyAdminURL string   `yaml:"proxyAdminURL"`
+	} `yaml:"api"`
+	Proxy yaml.Node `yaml:"proxy"` // Dành cho proxy server, bỏ qua ở đây
+}
+
+// Load nạp cấu hình theo thứ tự ưu tiên tăng dần: giá trị mặc định, file
+// YAML, biến môi trường API_*, rồi tham số dòng lệnh. Mật khẩu database và
+// khóa JWT có thể đọc từ file. Mọi giá trị đều được kiểm tra trước khi trả về.
+func Load(args []string) error {
+	var dbPasswordFile, jwtSecretFile string
+
+	// Lần đọc flag đầu tiên chỉ để lấy đường dẫn file cấu hình
+	path := os.Getenv(EnvConfigFile)
+	probe := flag.NewFlagSet("api", flag.ContinueOnError)
+	probe.SetOutput(io.Discard)
+	probe.StringVar(&path, "config", path, "")
+	probe.Parse(args)
+
+	if path != "" {
+		files, err := loadFile(path)
+		if err != nil {
+			return err
+		}
+		dbPasswordFile = files.Database.PasswordFile
+		jwtSecretFile = files.API.JWTSecretFile
+	}
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	fs.StringVar(&path, "config", path, "đường dẫn file cấu hình YAML (env "+EnvConfigFile+")")
+	fs.StringVar(&ServerPort, "port", ServerPort, "cổng API server")
+	fs.StringVar(&DBHost, "db-host", DBHost, "MySQL host")
+	fs.StringVar(&DBPort, "db-port", DBPort, "MySQL port")
+	fs.StringVar(&DBUser, "db-user", DBUser, "MySQL user")
+	fs.StringVar(&DBPassword, "db-password", DBPassword, "mật khẩu MySQL, nên dùng -db-password-file")
+	fs.StringVar(&dbPasswordFile, "db-password-file", dbPasswordFile, "file chứa mật khẩu MySQL")
+	fs.StringVar(&DBName, "db-name", DBName, "tên database MySQL")
+	fs.StringVar(&JWTSecret, "jwt-secret", JWTSecret, "khóa bí mật ký JWT, nên dùng -jwt-secret-file")
+	fs.StringVar(&jwtSecretFile, "jwt-secret-file", jwtSecretFile, "file chứa khóa bí mật ký JWT")
+	fs.IntVar(&JWTExpiration, "jwt-expiration", JWTExpiration, "thời gian hết hạn của token (giờ)")
+	fs.StringVar(&ProxyAdminURL, "proxy-admin-url", ProxyAdminURL, "địa chỉ admin listener của proxy server, trống là tắt API quản lý lệnh cấm")
+	fs.Func("admin-users", "danh sách tài khoản admin, phân tách bằng dấu phẩy", func(value string) error {
+		AdminUsers = splitList(value)
+		return nil
+	})
+
+	if err := applyEnv(fs); err != nil {
+		return err
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Đọc các giá trị bí mật từ file
+	if dbPasswordFile != "" {
+		secret, err := readSecretFile(dbPasswordFile)
+		if err != nil {
+			return err
+		}
+		DBPassword = secret
+	}
+	if jwtSecretFile != "" {
+		secret, err := readSecretFile(jwtSecretFile)
+		if err != nil {
+			return err
+		}
+		JWTSecret = secret
+	}
+
+	return validate()
+}
+
+// loadFile đọc file YAML và ghi đè các giá trị có trong file
+func loadFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("không thể đọc file cấu hình: %v", err)
+	}
+
+	var files fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&files); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("file cấu hình %s không hợp lệ: %v", path, err)
+	}
+
+	setString := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	setString(&DBHost, files.Database.Host)
+	if files.Database.Port != 0 {
+		DBPort = strconv.Itoa(files.Database.Port)
+	}
+	setString(&DBUser, files.Database.User)
+	setString(&DBPassword, files.Database.Password)
+	setString(&DBName, files.Database.Name)
+	setString(&ServerPort, files.API.Port)
+	setString(&JWTSecret, files.API.JWTSecret)
+	if files.API.JWTExpiration != 0 {
+		JWTExpiration = files.API.JWTExpiration
+	}
+	if files.API.AdminUsers != nil {
+		AdminUsers = files.API.AdminUsers
+	}
+	setString(&ProxyAdminURL, files.API.ProxyAdminURL)
+
+	return &files, nil
+}
+
+// applyEnv gán giá trị cho các flag có biến môi trường tương ứng
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("%s không hợp lệ: %v", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// validate kiểm tra toàn bộ cấu hình và báo tất cả lỗi cùng lúc
+func validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(ServerPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("api.port: cổng không hợp lệ %q", ServerPort))
+	}
+	if DBHost == "" {
+		errs = append(errs, errors.New("database.host: không được để trống"))
+	}
+	if port, err := strconv.Atoi(DBPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("database.port: cổng không hợp lệ %q", DBPort))
+	}
+	if DBUser == "" {
+		errs = append(errs, errors.New("database.user: không được để trống"))
+	}
+	if DBName == "" {
+		errs = append(errs, errors.New("database.name: không được để trống"))
+	}
+	if JWTSecret == "" {
+		errs = append(errs, errors.New("api.jwtSecret: bắt buộc, đặt qua jwtSecretFile, API_JWT_SECRET hoặc -jwt-secret-file"))
+	}
+	if JWTExpiration <= 0 {
+		errs = append(errs, fmt.Errorf("api.jwtExpiration: phải lớn hơn 0, nhận được %d", JWTExpiration))
+	}
+	if len(AdminUsers) == 0 {
+		errs = append(errs, errors.New("api.adminUsers: cần ít nhất một tài khoản"))
+	}
+	if ProxyAdminURL != "" {
+		if u, err := url.Parse(ProxyAdminURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("api.proxyAdminURL: địa chỉ không hợp lệ %q, cần dạng http://host:port", ProxyAdminURL))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cấu hình không hợp lệ:\n%v", errors.Join(errs...))
+	}
+	return nil
+}
+
+// readSecretFile đọc giá trị bí mật từ file, bỏ ký tự xuống dòng ở cuối
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("không thể đọc file bí mật: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// splitList tách chuỗi phân tách bằng dấu phẩy thành danh sách
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
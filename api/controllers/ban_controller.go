@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tuantech/proxy-server/api/config"
+)
+
+// proxyAdminTimeout là thời gian chờ tối đa khi gọi admin listener của proxy
+const proxyAdminTimeout = 10 * time.Second
+
+// proxyAdminClient gọi admin listener của proxy server
+var proxyAdminClient = &http.Client{Timeout: proxyAdminTimeout}
+
+// GetBans xử lý yêu cầu lấy danh sách địa chỉ IP và username đang bị cấm
+func GetBans(c *gin.Context) {
+	forwardAdmin(c, http.MethodGet, "/bans", "address", "username")
+}
+
+// ClearBans xử lý yêu cầu gỡ lệnh cấm: của một địa chỉ (?address=), của một
+// username (?username=) hoặc tất cả khi không có tham số
+func ClearBans(c *gin.Context) {
+	forwardAdmin(c, http.MethodDelete, "/bans", "address", "username")
+}
+
+// forwardAdmin chuyển yêu cầu đến path trên admin listener của proxy server,
+// nơi giữ lệnh cấm và phiên đang mở trong bộ nhớ, kèm các tham số params, và
+// trả về nguyên kết quả
+func forwardAdmin(c *gin.Context, method, path string, params ...string) {
+	if config.ProxyAdminURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Proxy admin endpoint is not configured"})
+		return
+	}
+
+	// Chỉ chuyển tiếp các tham số proxy hiểu
+	query := url.Values{}
+	for _, name := range params {
+		if value := c.Query(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	target := strings.TrimRight(config.ProxyAdminURL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, target, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build proxy request"})
+		return
+	}
+	resp, err := proxyAdminClient.Do(req)
+	if err != nil {
+		log.Printf("Không thể kết nối đến admin listener của proxy: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Proxy server unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+}
@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSessions xử lý yêu cầu lấy danh sách phiên đang mở trên proxy, hoặc của
+// một người dùng (?username=)
+func GetSessions(c *gin.Context) {
+	forwardAdmin(c, http.MethodGet, "/sessions", "username")
+}
+
+// CloseSession xử lý yêu cầu đóng cưỡng bức một phiên đang mở theo ID
+func CloseSession(c *gin.Context) {
+	forwardAdmin(c, http.MethodDelete, "/sessions/"+url.PathEscape(c.Param("id")))
+}
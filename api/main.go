@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tuantech/proxy-server/api/config"
@@ -11,6 +14,14 @@ import (
 )
 
 func main() {
+	// Nạp cấu hình từ file, biến môi trường và tham số dòng lệnh
+	if err := config.Load(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+
 	// Khởi tạo kết nối database
 	db, err := database.InitDB()
 	if err != nil {
@@ -35,6 +46,14 @@ func main() {
 		auth.DELETE("/users/:username", controllers.DeleteUser)
 		auth.PUT("/users/:username/password", controllers.ResetPassword)
 		auth.PUT("/change-password", controllers.ChangePassword)
+
+		// Lệnh cấm tạm thời do đăng nhập proxy sai nhiều lần
+		auth.GET("/bans", controllers.GetBans)
+		auth.DELETE("/bans", controllers.ClearBans)
+
+		// Phiên đang mở trên proxy
+		auth.GET("/sessions", controllers.GetSessions)
+		auth.DELETE("/sessions/:id", controllers.CloseSession)
 	}
 
 	// Khởi động server
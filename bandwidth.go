@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How often the rates of connected users are re-read from the database,
+	// so limit changes reach running sessions
+	BANDWIDTH_RELOAD_INTERVAL = 30 * time.Second
+
+	// Smallest burst of a shared limiter. It must hold a whole UDP datagram
+	// and a proxyData buffer.
+	BANDWIDTH_MIN_BURST = UDP_BUFFER_SIZE
+)
+
+// newBandwidthLimiter returns a limiter for a rate in bytes per second, with
+// a one second burst. A rate of 0 or less means unlimited.
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Inf, BANDWIDTH_MIN_BURST)
+	setBandwidth(limiter, bytesPerSecond)
+	return limiter
+}
+
+// setBandwidth changes the rate of a limiter in place. Sessions waiting on
+// it pick up the new rate immediately.
+func setBandwidth(limiter *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetBurst(max(int(bytesPerSecond), BANDWIDTH_MIN_BURST))
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// waitBandwidth blocks until every limiter allows n bytes. nil limiters are
+// skipped.
+func waitBandwidth(limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.WaitN(context.Background(), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowBandwidth reports whether every limiter has n bytes available right
+// now. Datagrams over the limit are dropped instead of delayed.
+func allowBandwidth(limiters []*rate.Limiter, n int) bool {
+	now := time.Now()
+	for _, limiter := range limiters {
+		if limiter != nil && !limiter.AllowN(now, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// userBandwidth holds the limiters shared by all live sessions of a user
+type userBandwidth struct {
+	Upload   *rate.Limiter // Client to destination
+	Download *rate.Limiter // Destination to client
+	sessions int
+}
+
+// bandwidthRegistry hands out per-user limiters, created when a user's first
+// session starts and dropped when the last one ends, plus the optional
+// server-wide cap every session shares
+type bandwidthRegistry struct {
+	mutex sync.Mutex
+	users map[string]*userBandwidth
+
+	GlobalUpload   *rate.Limiter
+	GlobalDownload *rate.Limiter
+}
+
+// newBandwidthRegistry creates a registry with a server-wide cap per
+// direction, 0 for none
+func newBandwidthRegistry(globalRate int64) *bandwidthRegistry {
+	return &bandwidthRegistry{
+		users:          make(map[string]*userBandwidth),
+		GlobalUpload:   newBandwidthLimiter(globalRate),
+		GlobalDownload: newBandwidthLimiter(globalRate),
+	}
+}
+
+// setGlobal changes the server-wide cap for running sessions
+func (r *bandwidthRegistry) setGlobal(globalRate int64) {
+	setBandwidth(r.GlobalUpload, globalRate)
+	setBandwidth(r.GlobalDownload, globalRate)
+}
+
+// acquire returns the shared limiters of a user for a new session. The rates
+// just read from the database apply to the user's running sessions as well.
+// Every acquire must be paired with a release.
+func (r *bandwidthRegistry) acquire(user *User) *userBandwidth {
+	if user == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bandwidth, ok := r.users[user.Username]
+	if !ok {
+		bandwidth = &userBandwidth{
+			Upload:   newBandwidthLimiter(user.UploadRate),
+			Download: newBandwidthLimiter(user.DownloadRate),
+		}
+		r.users[user.Username] = bandwidth
+	} else {
+		setBandwidth(bandwidth.Upload, user.UploadRate)
+		setBandwidth(bandwidth.Download, user.DownloadRate)
+	}
+	bandwidth.sessions++
+	return bandwidth
+}
+
+// release ends a session started with acquire
+func (r *bandwidthRegistry) release(user *User) {
+	if user == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if bandwidth, ok := r.users[user.Username]; ok {
+		bandwidth.sessions--
+		if bandwidth.sessions <= 0 {
+			delete(r.users, user.Username)
+		}
+	}
+}
+
+// refresh re-reads the rates of every user with a live session
+func (r *bandwidthRegistry) refresh(db *sql.DB) error {
+	r.mutex.Lock()
+	usernames := make([]any, 0, len(r.users))
+	for username := range r.users {
+		usernames = append(usernames, username)
+	}
+	r.mutex.Unlock()
+
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	query := "SELECT username, uploadRate, downloadRate FROM user WHERE username IN (?" +
+		strings.Repeat(", ?", len(usernames)-1) + ")"
+	rows, err := db.Query(query, usernames...)
+	if err != nil {
+		return fmt.Errorf("failed to query user rates: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		var upload, download int64
+		if err := rows.Scan(&username, &upload, &download); err != nil {
+			return fmt.Errorf("failed to read user rates: %v", err)
+		}
+
+		r.mutex.Lock()
+		if bandwidth, ok := r.users[username]; ok {
+			setBandwidth(bandwidth.Upload, upload)
+			setBandwidth(bandwidth.Download, download)
+		}
+		r.mutex.Unlock()
+	}
+	return rows.Err()
+}
+
+// sessionBandwidth returns the limiters a new session of user waits on in
+// each direction: its own, fixed when the session starts, and the server-wide
+// cap and the user's limiters, which are shared with other sessions and
+// follow limit changes while the session runs. It acquires the user's
+// limiters, so the session must call s.bandwidth.release when it ends.
+func (s *ProxyServer) sessionBandwidth(rt *runtimeConfig, user *User) (upload, download []*rate.Limiter) {
+	upload = []*rate.Limiter{rate.NewLimiter(rt.RateLimit, rt.BurstLimit), s.bandwidth.GlobalUpload}
+	download = []*rate.Limiter{rate.NewLimiter(rt.RateLimit, rt.BurstLimit), s.bandwidth.GlobalDownload}
+	if bandwidth := s.bandwidth.acquire(user); bandwidth != nil {
+		upload = append(upload, bandwidth.Upload)
+		download = append(download, bandwidth.Download)
+	}
+	return upload, download
+}
+
+// bandwidthReader delays reads until its limiters allow the bytes. Reads are
+// capped at PROXY_BUFFER_SIZE so that they fit in a limiter's burst, like
+// those of proxyData.
+type bandwidthReader struct {
+	io.ReadCloser
+	limiters []*rate.Limiter
+}
+
+func (r *bandwidthReader) Read(b []byte) (int, error) {
+	if len(b) > PROXY_BUFFER_SIZE {
+		b = b[:PROXY_BUFFER_SIZE]
+	}
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		if err := waitBandwidth(r.limiters, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// bandwidthWriter delays writes until its limiters allow the bytes, in
+// chunks of at most PROXY_BUFFER_SIZE
+type bandwidthWriter struct {
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+func (w *bandwidthWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), PROXY_BUFFER_SIZE)]
+		if err := waitBandwidth(w.limiters, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// watchBandwidth applies rate changes from the database to running sessions
+// until ctx is cancelled
+func (s *ProxyServer) watchBandwidth(ctx context.Context) {
+	ticker := time.NewTicker(BANDWIDTH_RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.bandwidth.refresh(s.DB); err != nil {
+				s.Logger.Error("Failed to reload bandwidth limits", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// handleBind processes a SOCKS5 BIND request (RFC 1928 section 4).
+//
+// The proxy opens a listening socket on the interface the client reached us
+// on, replies with its address, waits for exactly one inbound connection and
+// replies a second time with the address of the connecting peer. The session
+// keeps the connection slot the client took in performAuth, released when the
+// connection handler returns like any other session. Replies are
+// written through reply so SOCKS4 and SOCKS5 share the same implementation.
+// BIND is refused behind a parent proxy chain, since the peer would reach
+// the proxy's own address instead of going through the chain.
+func (s *ProxyServer) handleBind(conn net.Conn, rt *runtimeConfig, dstIP net.IP, dstPort uint16, reply replyFunc) error {
+	if rt.Dialer.UsesChain() {
+		reply(COMMAND_NOT_SUPPORTED, nil)
+		return errors.New("BIND is not supported through upstream proxies")
+	}
+
+	// Listen on the same local IP the client connected to so that the
+	// address in the first reply is reachable by the application server
+	localIP := net.IPv4zero
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+
+	// The session names the expected peer, if the client gave one
+	var host string
+	if dstIP != nil {
+		host = dstIP.String()
+	}
+	session := s.newSession(conn, host, int(dstPort))
+
+	// The ACL applies to the peer like to a CONNECT destination. A peer the
+	// client named is checked before listening, any other once it connects.
+	user := s.connectionUser(conn)
+	namedPeer := dstIP != nil && !dstIP.IsUnspecified()
+	if namedPeer {
+		if err := s.checkDestination(user, host, []net.IP{dstIP}, int(dstPort)); err != nil {
+			reply(CONNECTION_NOT_ALLOWED, nil)
+			s.rejectSession(session, CONNECTION_NOT_ALLOWED)
+			return err
+		}
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP, Port: 0})
+	if err != nil {
+		reply(GENERAL_FAILURE, nil)
+		s.rejectSession(session, GENERAL_FAILURE)
+		return fmt.Errorf("failed to open BIND listener: %v", err)
+	}
+	defer listener.Close()
+
+	// First reply: the address the application server should connect to
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	if err := reply(SUCCEEDED, bindAddr); err != nil {
+		return err
+	}
+
+	listener.SetDeadline(time.Now().Add(BIND_ACCEPT_TIMEOUT))
+	stopWatching := s.watchBind(conn, listener)
+	peerConn, err := listener.AcceptTCP()
+	stopped := stopWatching()
+	if err != nil {
+		replyCode := byte(GENERAL_FAILURE)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			replyCode = TTL_EXPIRED
+		}
+		reply(replyCode, nil)
+		s.rejectSession(session, replyCode)
+		if stopped != nil {
+			return fmt.Errorf("BIND accept aborted: %v", stopped)
+		}
+		return fmt.Errorf("BIND accept failed: %v", err)
+	}
+	defer peerConn.Close()
+
+	// Only one inbound connection is accepted per BIND request
+	listener.Close()
+
+	// When the client named the expected peer, refuse anyone else
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+	session.ResolvedIP = peerAddr.IP.String()
+	if namedPeer && !dstIP.Equal(peerAddr.IP) {
+		err = fmt.Errorf("BIND peer %s does not match requested address %s:%d", peerAddr, dstIP, dstPort)
+	} else if !namedPeer {
+		err = s.checkDestination(user, peerAddr.IP.String(), []net.IP{peerAddr.IP}, int(dstPort))
+	}
+	if err != nil {
+		reply(CONNECTION_NOT_ALLOWED, nil)
+		s.rejectSession(session, CONNECTION_NOT_ALLOWED)
+		return err
+	}
+
+	// Second reply: the address of the connecting host
+	if err := reply(SUCCEEDED, peerAddr); err != nil {
+		return err
+	}
+
+	s.proxyData(conn, peerConn, session)
+	return nil
+}
+
+// watchBind closes listener when the client disconnects or the server starts
+// draining, so that a pending BIND does not wait for its peer until
+// BIND_ACCEPT_TIMEOUT. The client sends nothing before the second reply, so
+// it is watched by peeking at its connection without consuming data. The
+// returned function stops watching and reports why listener was closed, or
+// nil if it was not.
+func (s *ProxyServer) watchBind(conn net.Conn, listener *net.TCPListener) func() error {
+	var reason error
+	var mutex sync.Mutex
+	abort := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if reason == nil {
+			reason = err
+			listener.Close()
+		}
+	}
+
+	stop := make(chan struct{})
+	draining := make(chan struct{})
+	go func() {
+		defer close(draining)
+		select {
+		case <-s.draining:
+			abort(errors.New("server is shutting down"))
+		case <-stop:
+		}
+	}()
+
+	peeked := make(chan struct{})
+	bconn, ok := conn.(*bufferedConn)
+	if ok {
+		go func() {
+			defer close(peeked)
+			if _, err := bconn.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				abort(fmt.Errorf("client connection closed: %v", err))
+			}
+		}()
+	} else {
+		close(peeked)
+	}
+
+	return func() error {
+		close(stop)
+		<-draining
+		// Unblock the peek before the connection is read again
+		if ok {
+			conn.SetReadDeadline(time.Now())
+			<-peeked
+			conn.SetReadDeadline(time.Time{})
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		// The peer's connection wins over a late abort
+		return reason
+	}
+}
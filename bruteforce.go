@@ -0,0 +1,370 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of proxy.bruteForce
+	BRUTE_FORCE_WINDOW         = 10 * time.Minute
+	BRUTE_FORCE_IP_THRESHOLD   = 10
+	BRUTE_FORCE_USER_THRESHOLD = 50
+	BRUTE_FORCE_BAN_DURATION   = 15 * time.Minute
+	BRUTE_FORCE_BACKOFF        = 250 * time.Millisecond
+	BRUTE_FORCE_MAX_BACKOFF    = 5 * time.Second
+
+	// Most addresses and usernames tracked at once, so that a flood of
+	// sources cannot exhaust memory. When full, the record that failed least
+	// recently makes room for a new one; bans are never dropped.
+	BRUTE_FORCE_MAX_ENTRIES = 100000
+
+	// IPv6 clients are tracked by their /64, which usually belongs to a
+	// single host, so they cannot dodge a ban by changing address
+	BRUTE_FORCE_IPV6_PREFIX = 64
+
+	// What a ban applies to
+	BAN_ADDRESS  = "address"
+	BAN_USERNAME = "username"
+)
+
+var ErrBanned = errors.New("temporarily banned after repeated authentication failures")
+
+// BruteForceConfig describes how failed password logins are throttled. Each
+// failure delays the reply, and an address or a username that fails too
+// often within the window is banned for a while.
+type BruteForceConfig struct {
+	Window        time.Duration `yaml:"window"`        // How long a failure counts towards a ban
+	IPThreshold   int           `yaml:"ipThreshold"`   // Failures from one address that ban it, 0 to never ban addresses
+	UserThreshold int           `yaml:"userThreshold"` // Failures against one username that ban it, 0 to never ban usernames
+	BanDuration   time.Duration `yaml:"banDuration"`
+	Backoff       time.Duration `yaml:"backoff"` // Delay of the reply to a first failure, doubled for each further one, 0 for none
+	MaxBackoff    time.Duration `yaml:"maxBackoff"`
+	Allowlist     []string      `yaml:"allowlist"` // CIDRs or IPs that are never delayed nor banned
+
+	allowlist []*net.IPNet // Parsed by validate
+}
+
+// validate checks the brute-force settings, reporting problems through
+// invalid
+func (c *BruteForceConfig) validate(invalid func(name, format string, args ...any)) {
+	if c.Window <= 0 {
+		invalid("proxy.bruteForce.window", "must be positive, got %s", c.Window)
+	}
+	if c.IPThreshold < 0 {
+		invalid("proxy.bruteForce.ipThreshold", "must not be negative, got %d", c.IPThreshold)
+	}
+	if c.UserThreshold < 0 {
+		invalid("proxy.bruteForce.userThreshold", "must not be negative, got %d", c.UserThreshold)
+	}
+	if c.BanDuration <= 0 {
+		invalid("proxy.bruteForce.banDuration", "must be positive, got %s", c.BanDuration)
+	}
+	if c.Backoff < 0 {
+		invalid("proxy.bruteForce.backoff", "must not be negative, got %s", c.Backoff)
+	}
+	if c.MaxBackoff < c.Backoff {
+		invalid("proxy.bruteForce.maxBackoff", "must be at least backoff (%s), got %s", c.Backoff, c.MaxBackoff)
+	}
+
+	var err error
+	if c.allowlist, err = parseNetworks(c.Allowlist); err != nil {
+		invalid("proxy.bruteForce.allowlist", "%v", err)
+	}
+}
+
+// BanInfo is a snapshot of a ban
+type BanInfo struct {
+	Kind     string    `json:"kind"` // address or username
+	Key      string    `json:"key"`  // The IP address, IPv6 /64 or username
+	Failures int       `json:"failures"`
+	BannedAt time.Time `json:"bannedAt"`
+	Until    time.Time `json:"until"`
+}
+
+// failureRecord counts the recent failures of an address or a username
+type failureRecord struct {
+	failures    int
+	windowStart time.Time // Failures before it no longer count
+	lastFailure time.Time
+	bannedAt    time.Time
+	bannedUntil time.Time // Zero when not banned
+}
+
+// banned reports whether the record is banned at now
+func (r *failureRecord) banned(now time.Time) bool {
+	return now.Before(r.bannedUntil)
+}
+
+// bruteForceGuard tracks failed password logins by client address and by
+// username, in memory. Certificate logins are not tracked.
+type bruteForceGuard struct {
+	mutex     sync.Mutex
+	config    BruteForceConfig
+	addresses map[string]*failureRecord
+	usernames map[string]*failureRecord
+	pruned    time.Time
+}
+
+// newBruteForceGuard creates a guard for a validated config
+func newBruteForceGuard(cfg BruteForceConfig) *bruteForceGuard {
+	return &bruteForceGuard{
+		config:    cfg,
+		addresses: make(map[string]*failureRecord),
+		usernames: make(map[string]*failureRecord),
+		pruned:    time.Now(),
+	}
+}
+
+// configure applies new settings. Failures and bans already recorded are
+// kept.
+func (g *bruteForceGuard) configure(cfg BruteForceConfig) {
+	g.mutex.Lock()
+	g.config = cfg
+	g.mutex.Unlock()
+}
+
+// addressKey returns the key an IP is tracked under, or an empty string for
+// clients without one, like those of unix sockets
+func addressKey(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	mask := net.CIDRMask(BRUTE_FORCE_IPV6_PREFIX, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// clientIP returns the IP address of the client of conn, or nil for unix
+// sockets
+func clientIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// exempt reports whether ip is on the allowlist. The caller must hold mutex.
+func (g *bruteForceGuard) exempt(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range g.config.allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bannedAddress reports whether connections from ip are refused
+func (g *bruteForceGuard) bannedAddress(ip net.IP) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.exempt(ip) {
+		return false
+	}
+	record, ok := g.addresses[addressKey(ip)]
+	return ok && record.banned(time.Now())
+}
+
+// banned reports whether a login from ip to username is refused without
+// checking the password
+func (g *bruteForceGuard) banned(ip net.IP, username string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.exempt(ip) {
+		return false
+	}
+	now := time.Now()
+	if record, ok := g.addresses[addressKey(ip)]; ok && record.banned(now) {
+		return true
+	}
+	record, ok := g.usernames[username]
+	return ok && record.banned(now)
+}
+
+// fail records a failed login from ip to username. It returns how long the
+// reply should be delayed and the bans the failure started.
+func (g *bruteForceGuard) fail(ip net.IP, username string) (time.Duration, []BanInfo) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.exempt(ip) {
+		return 0, nil
+	}
+	now := time.Now()
+	g.prune(now)
+
+	var failures int
+	var bans []BanInfo
+	count := func(kind string, records map[string]*failureRecord, key string, threshold int) {
+		if key == "" {
+			return
+		}
+		record, ok := records[key]
+		if !ok {
+			if len(records) >= BRUTE_FORCE_MAX_ENTRIES && !evictOldest(records, now) {
+				return
+			}
+			record = &failureRecord{windowStart: now}
+			records[key] = record
+		}
+		if now.Sub(record.windowStart) >= g.config.Window {
+			record.failures = 0
+			record.windowStart = now
+		}
+		record.failures++
+		record.lastFailure = now
+		failures = max(failures, record.failures)
+
+		if threshold > 0 && record.failures >= threshold && !record.banned(now) {
+			record.bannedAt = now
+			record.bannedUntil = now.Add(g.config.BanDuration)
+			bans = append(bans, banInfo(kind, key, record))
+		}
+	}
+	count(BAN_ADDRESS, g.addresses, addressKey(ip), g.config.IPThreshold)
+	count(BAN_USERNAME, g.usernames, username, g.config.UserThreshold)
+
+	return g.backoff(failures), bans
+}
+
+// backoff returns the delay of the reply to the nth failure in a row. The
+// caller must hold mutex.
+func (g *bruteForceGuard) backoff(failures int) time.Duration {
+	delay := g.config.Backoff
+	if delay == 0 || failures == 0 {
+		return 0
+	}
+	for i := 1; i < failures && delay < g.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, g.config.MaxBackoff)
+}
+
+// succeed forgets the failures of a username once its password was given.
+// The failures of the address are kept, so that guessing from an address
+// with one valid account is still caught.
+func (g *bruteForceGuard) succeed(username string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if record, ok := g.usernames[username]; ok && !record.banned(time.Now()) {
+		delete(g.usernames, username)
+	}
+}
+
+// prune drops the records whose failures and ban have expired, at most once
+// per window. The caller must hold mutex.
+func (g *bruteForceGuard) prune(now time.Time) {
+	if now.Sub(g.pruned) < g.config.Window {
+		return
+	}
+	g.pruned = now
+	for _, records := range []map[string]*failureRecord{g.addresses, g.usernames} {
+		for key, record := range records {
+			if now.Sub(record.windowStart) >= g.config.Window && !record.banned(now) {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// evictOldest drops the record that is not banned and failed least recently.
+// It reports false when every record is banned.
+func evictOldest(records map[string]*failureRecord, now time.Time) bool {
+	var oldestKey string
+	var oldest *failureRecord
+	for key, record := range records {
+		if !record.banned(now) && (oldest == nil || record.lastFailure.Before(oldest.lastFailure)) {
+			oldestKey, oldest = key, record
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(records, oldestKey)
+	return true
+}
+
+// banInfo returns a snapshot of a banned record
+func banInfo(kind, key string, record *failureRecord) BanInfo {
+	return BanInfo{
+		Kind:     kind,
+		Key:      key,
+		Failures: record.failures,
+		BannedAt: record.bannedAt,
+		Until:    record.bannedUntil,
+	}
+}
+
+// List returns the current bans, oldest first
+func (g *bruteForceGuard) List() []BanInfo {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	bans := []BanInfo{}
+	for kind, records := range map[string]map[string]*failureRecord{BAN_ADDRESS: g.addresses, BAN_USERNAME: g.usernames} {
+		for key, record := range records {
+			if record.banned(now) {
+				bans = append(bans, banInfo(kind, key, record))
+			}
+		}
+	}
+	slices.SortFunc(bans, func(a, b BanInfo) int {
+		return cmp.Or(a.BannedAt.Compare(b.BannedAt), cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Key, b.Key))
+	})
+	return bans
+}
+
+// Unban lifts the ban of an address or a username and forgets its failures.
+// An address may be given as an IP, whose IPv6 /64 is then unbanned. It
+// reports whether there was a ban to lift.
+func (g *bruteForceGuard) Unban(kind, key string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	records := g.usernames
+	if kind == BAN_ADDRESS {
+		records = g.addresses
+		if ip := net.ParseIP(key); ip != nil {
+			key = addressKey(ip)
+		}
+	}
+	record, ok := records[key]
+	if !ok || !record.banned(time.Now()) {
+		return false
+	}
+	delete(records, key)
+	return true
+}
+
+// Clear lifts every ban and forgets every failure. It returns the number of
+// bans lifted.
+func (g *bruteForceGuard) Clear() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	cleared := 0
+	for _, records := range []map[string]*failureRecord{g.addresses, g.usernames} {
+		for _, record := range records {
+			if record.banned(now) {
+				cleared++
+			}
+		}
+	}
+	g.addresses = make(map[string]*failureRecord)
+	g.usernames = make(map[string]*failureRecord)
+	return cleared
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"net"
+)
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader so the
+// first bytes of a connection can be inspected before choosing a protocol.
+// It is the connection every protocol handler receives, so it also carries
+// the client's live session.
+type bufferedConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	session *LiveSession
+}
+
+// newBufferedConn wraps conn with a read buffer
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Peek returns the next n bytes without consuming them
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
+// Read reads from the buffer first, then from the underlying connection
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// sessionOf returns the live session of a connection passed to a protocol
+// handler, or nil
+func sessionOf(conn net.Conn) *LiveSession {
+	if b, ok := conn.(*bufferedConn); ok {
+		return b.session
+	}
+	return nil
+}
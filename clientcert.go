@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Ways to map a client certificate to a row of the user table
+	CERT_USER_CN  = "cn"  // Subject common name
+	CERT_USER_SAN = "san" // First DNS, email or URI SAN naming an existing user
+)
+
+var (
+	ErrCertificateRevoked = errors.New("client certificate revoked")
+	ErrCertificateUnknown = errors.New("client certificate does not match a user")
+)
+
+// loadCABundle reads a PEM bundle of CA certificates used to verify client
+// certificates and CRL signatures
+func loadCABundle(path string) (*x509.CertPool, []*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client CA bundle: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate in client CA bundle: %v", err)
+		}
+		pool.AddCert(cert)
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("client CA bundle %s contains no certificates", path)
+	}
+	return pool, certs, nil
+}
+
+// revocationList holds the serial numbers revoked by the CRLs in a file and
+// reloads them when the file changes. Only CRLs signed by a CA of the client
+// CA bundle are accepted.
+type revocationList struct {
+	path string
+	cas  []*x509.Certificate
+
+	mutex   sync.Mutex
+	revoked map[string]map[string]bool // Raw issuer name to revoked serials
+	modTime time.Time
+	checked time.Time
+}
+
+// newRevocationList loads the CRLs in path, PEM or DER encoded
+func newRevocationList(path string, cas []*x509.Certificate) (*revocationList, error) {
+	r := &revocationList{path: path, cas: cas}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the CRL file. The caller must hold mutex once the list is in use.
+func (r *revocationList) load() error {
+	modTime, err := newestModTime(r.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read CRL: %v", err)
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	revoked := make(map[string]map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("invalid CRL in %s: %v", r.path, err)
+		}
+		if !r.signedByCA(crl) {
+			return fmt.Errorf("CRL in %s is not signed by a client CA", r.path)
+		}
+		issuer := string(crl.RawIssuer)
+		if revoked[issuer] == nil {
+			revoked[issuer] = make(map[string]bool)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[issuer][entry.SerialNumber.String()] = true
+		}
+	}
+
+	r.revoked = revoked
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// signedByCA reports whether a CA of the bundle signed crl
+func (r *revocationList) signedByCA(crl *x509.RevocationList) bool {
+	for _, ca := range r.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// check rejects a verified chain containing a revoked certificate. The file
+// is reloaded first when it changed, keeping the current list on error.
+func (r *revocationList) check(chain []*x509.Certificate) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) >= TLS_CERT_CHECK_INTERVAL {
+		r.checked = time.Now()
+		modTime, err := newestModTime(r.path)
+		if err == nil && !modTime.Equal(r.modTime) {
+			err = r.load()
+			if err == nil {
+				slog.Info("CRL reloaded", "crl", r.path)
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed to reload CRL, keeping the current one", "crl", r.path, "error", err)
+		}
+	}
+
+	for _, cert := range chain {
+		if r.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+			return fmt.Errorf("%w: serial %s", ErrCertificateRevoked, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// certificateUsernames lists the names a client certificate may map to, in
+// the order they are tried
+func certificateUsernames(cert *x509.Certificate, field string) []string {
+	if field == CERT_USER_SAN {
+		names := append([]string{}, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		return names
+	}
+	return []string{cert.Subject.CommonName}
+}
+
+// authenticateCertificate maps a verified client certificate to a user and
+// registers the session against the user's maxConnection limit, like a
+// password login. It does nothing when the client sent no certificate. A
+// failed user lookup returns ErrAuthUnavailable.
+func (s *ProxyServer) authenticateCertificate(conn *tls.Conn, l *listenerSettings, session *LiveSession) error {
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || !l.allows(AUTH_CERTIFICATE) {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+
+	for _, name := range certificateUsernames(cert, l.TLS.CertUser) {
+		if name == "" {
+			continue
+		}
+		user, err := s.lookupUser(name)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		// A database failure says nothing about the certificate
+		if err != nil {
+			s.Logger.Error("Failed to look up client certificate user", "client", conn.RemoteAddr().String(),
+				"username", name, "error", err)
+			return fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+		}
+		if err := s.registerConnection(session, user); err != nil {
+			return err
+		}
+		s.Logger.Info("Client certificate accepted", "client", conn.RemoteAddr().String(),
+			"username", user.Username, "serial", cert.SerialNumber.String())
+		return nil
+	}
+
+	return fmt.Errorf("%w: subject %q", ErrCertificateUnknown, cert.Subject.String())
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Environment variable naming the config file, used when -config is not set
+	CONFIG_ENV_FILE = "PROXY_CONFIG"
+
+	// Prefix of the environment variables overriding single settings. The
+	// rest of the name is the flag name in upper case, e.g. PROXY_DB_HOST.
+	CONFIG_ENV_PREFIX = "PROXY_"
+
+	// Size of the proxyData copy buffer, the smallest usable burst limit
+	PROXY_BUFFER_SIZE = 4096
+)
+
+// Config holds the proxy settings. Values are layered: built-in defaults,
+// then the YAML config file, then PROXY_* environment variables, then
+// command-line flags. The file is shared with the API server, which reads
+// the database and api sections.
+type Config struct {
+	Database DatabaseConfig `yaml:"database"`
+	Proxy    ProxyConfig    `yaml:"proxy"`
+	API      yaml.Node      `yaml:"api"` // Read by the API server, ignored here
+
+	// Parsed by Validate
+	chain     []ProxyHop
+	logLevel  slog.Level
+	listeners []*listenerSettings
+}
+
+// DatabaseConfig describes the MySQL connection
+type DatabaseConfig struct {
+	Host         string `yaml:"host"`
+	Port         int    `yaml:"port"`
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"` // Read into Password when set
+	Name         string `yaml:"name"`
+}
+
+// ProxyConfig holds the settings of the proxy itself
+type ProxyConfig struct {
+	Listen             string           `yaml:"listen"`    // Single TCP listener, used when Listeners is empty
+	Listeners          []ListenerConfig `yaml:"listeners"` // Listeners with their own settings
+	LogLevel           string           `yaml:"logLevel"`
+	RateLimit          int64            `yaml:"rateLimit"`       // Bytes per second, per direction
+	BurstLimit         int              `yaml:"burstLimit"`      // Bytes
+	GlobalRateLimit    int64            `yaml:"globalRateLimit"` // Bytes per second, per direction, for all sessions together, 0 for none
+	DialTimeout        time.Duration    `yaml:"dialTimeout"`
+	HandshakeTimeout   time.Duration    `yaml:"handshakeTimeout"`   // Deadline for the handshake, authentication and request
+	IdleTimeout        time.Duration    `yaml:"idleTimeout"`        // Time a tunnel may carry no data, 0 for no limit
+	MaxSessionDuration time.Duration    `yaml:"maxSessionDuration"` // Longest a session may last unless set per user, 0 for no limit
+	DrainTimeout       time.Duration    `yaml:"drainTimeout"`
+	DNSUpstreams       []string         `yaml:"dnsUpstreams"` // Empty for the system resolver
+	DNSTimeout         time.Duration    `yaml:"dnsTimeout"`
+	UpstreamProxies    []string         `yaml:"upstreamProxies"` // Parent proxy chain, in order
+	Socks4Separator    string           `yaml:"socks4Separator"`
+	MetricsListen      string           `yaml:"metricsListen"` // Address of the Prometheus endpoint, empty to disable it
+	AdminListen        string           `yaml:"adminListen"`   // Address of the admin endpoint, empty to disable it
+	AccessLog          AccessLogConfig  `yaml:"accessLog"`
+	BruteForce         BruteForceConfig `yaml:"bruteForce"`
+}
+
+// DefaultConfig returns the built-in defaults. There is no default database
+// password; it has to come from the config file, the environment or a file.
+func DefaultConfig() *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			Host: "127.0.0.1",
+			Port: 3306,
+			User: "root",
+			Name: "proxy",
+		},
+		Proxy: ProxyConfig{
+			Listen:           ":1080",
+			LogLevel:         "debug",
+			RateLimit:        RATE_LIMIT,
+			BurstLimit:       BURST_LIMIT,
+			DialTimeout:      DIAL_TIMEOUT,
+			HandshakeTimeout: HANDSHAKE_TIMEOUT,
+			IdleTimeout:      IDLE_TIMEOUT,
+			DrainTimeout:     SHUTDOWN_DRAIN_TIMEOUT,
+			DNSTimeout:       DNS_QUERY_TIMEOUT,
+			Socks4Separator:  SOCKS4_USERID_SEPARATOR,
+			AccessLog: AccessLogConfig{
+				Format:      ACCESS_LOG_JSON,
+				File:        ACCESS_LOG_DEFAULT_FILE,
+				MaxSize:     ACCESS_LOG_MAX_SIZE,
+				RotateEvery: ACCESS_LOG_ROTATE_EVERY,
+				MaxBackups:  ACCESS_LOG_MAX_BACKUPS,
+				SyslogTag:   ACCESS_LOG_SYSLOG_TAG,
+			},
+			BruteForce: BruteForceConfig{
+				Window:        BRUTE_FORCE_WINDOW,
+				IPThreshold:   BRUTE_FORCE_IP_THRESHOLD,
+				UserThreshold: BRUTE_FORCE_USER_THRESHOLD,
+				BanDuration:   BRUTE_FORCE_BAN_DURATION,
+				Backoff:       BRUTE_FORCE_BACKOFF,
+				MaxBackoff:    BRUTE_FORCE_MAX_BACKOFF,
+			},
+		},
+	}
+}
+
+// LoadConfig builds the configuration from every layer and validates it
+func LoadConfig(args []string) (*Config, error) {
+	// A first pass over the flags only finds the config file. They are
+	// parsed again at the end so they override the file and environment.
+	path := os.Getenv(CONFIG_ENV_FILE)
+	if err := DefaultConfig().flagSet(&path).Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := cfg.flagSet(&path)
+	if err := applyEnv(flags, CONFIG_ENV_PREFIX); err != nil {
+		return nil, err
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.Database.PasswordFile != "" {
+		password, err := readSecretFile(cfg.Database.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Database.Password = password
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// flagSet binds a command-line flag to every setting. Flag names also define
+// the environment variable names.
+func (c *Config) flagSet(path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy-server", flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "path to the YAML config file (env "+CONFIG_ENV_FILE+")")
+
+	fs.StringVar(&c.Database.Host, "db-host", c.Database.Host, "MySQL host")
+	fs.IntVar(&c.Database.Port, "db-port", c.Database.Port, "MySQL port")
+	fs.StringVar(&c.Database.User, "db-user", c.Database.User, "MySQL user")
+	fs.StringVar(&c.Database.Password, "db-password", c.Database.Password, "MySQL password, prefer -db-password-file")
+	fs.StringVar(&c.Database.PasswordFile, "db-password-file", c.Database.PasswordFile, "file containing the MySQL password")
+	fs.StringVar(&c.Database.Name, "db-name", c.Database.Name, "MySQL database name")
+
+	fs.StringVar(&c.Proxy.Listen, "listen", c.Proxy.Listen, "address of the single TCP listener, ignored when proxy.listeners is set")
+	fs.StringVar(&c.Proxy.LogLevel, "log-level", c.Proxy.LogLevel, "log level: debug, info, warn or error")
+	fs.Int64Var(&c.Proxy.RateLimit, "rate-limit", c.Proxy.RateLimit, "bandwidth limit per direction in bytes per second")
+	fs.IntVar(&c.Proxy.BurstLimit, "burst-limit", c.Proxy.BurstLimit, "bandwidth burst size in bytes")
+	fs.Int64Var(&c.Proxy.GlobalRateLimit, "global-rate-limit", c.Proxy.GlobalRateLimit, "server-wide bandwidth limit per direction in bytes per second, 0 for none")
+	fs.DurationVar(&c.Proxy.DialTimeout, "dial-timeout", c.Proxy.DialTimeout, "deadline for connecting to a destination")
+	fs.DurationVar(&c.Proxy.HandshakeTimeout, "handshake-timeout", c.Proxy.HandshakeTimeout, "deadline for a client to negotiate, authenticate and send its request")
+	fs.DurationVar(&c.Proxy.IdleTimeout, "idle-timeout", c.Proxy.IdleTimeout, "time a tunnel may carry no data before it is closed, 0 for no limit")
+	fs.DurationVar(&c.Proxy.MaxSessionDuration, "max-session-duration", c.Proxy.MaxSessionDuration, "longest a session may last unless the user sets maxSessionSeconds, 0 for no limit")
+	fs.DurationVar(&c.Proxy.DrainTimeout, "drain-timeout", c.Proxy.DrainTimeout, "time in-flight sessions get to finish on SIGTERM")
+	fs.Var((*listValue)(&c.Proxy.DNSUpstreams), "dns-upstreams", "comma-separated DNS upstreams (udp://, tcp://, tls://, https://), empty for the system resolver")
+	fs.DurationVar(&c.Proxy.DNSTimeout, "dns-timeout", c.Proxy.DNSTimeout, "timeout of a single DNS query")
+	fs.Var((*listValue)(&c.Proxy.UpstreamProxies), "upstream-proxies", "comma-separated parent proxy chain (socks5://, http://)")
+	fs.StringVar(&c.Proxy.Socks4Separator, "socks4-separator", c.Proxy.Socks4Separator, "separator between username and password in the SOCKS4 USERID")
+	fs.StringVar(&c.Proxy.MetricsListen, "metrics-listen", c.Proxy.MetricsListen, "address serving Prometheus metrics on "+METRICS_PATH+", empty to disable")
+	fs.StringVar(&c.Proxy.AdminListen, "admin-listen", c.Proxy.AdminListen, "address serving the admin endpoint on "+ADMIN_BANS_PATH+", empty to disable")
+
+	fs.StringVar(&c.Proxy.AccessLog.Output, "access-log", c.Proxy.AccessLog.Output, "access log output: stdout, file or syslog, empty to disable")
+	fs.StringVar(&c.Proxy.AccessLog.Format, "access-log-format", c.Proxy.AccessLog.Format, "access log format: json or logfmt")
+	fs.StringVar(&c.Proxy.AccessLog.File, "access-log-file", c.Proxy.AccessLog.File, "access log file when -access-log is file")
+	fs.Int64Var(&c.Proxy.AccessLog.MaxSize, "access-log-max-size", c.Proxy.AccessLog.MaxSize, "bytes after which the access log file is rotated, 0 for no limit")
+	fs.DurationVar(&c.Proxy.AccessLog.RotateEvery, "access-log-rotate-every", c.Proxy.AccessLog.RotateEvery, "age after which the access log file is rotated, 0 for no limit")
+	fs.IntVar(&c.Proxy.AccessLog.MaxBackups, "access-log-max-backups", c.Proxy.AccessLog.MaxBackups, "rotated access log files kept, 0 to keep all")
+	fs.StringVar(&c.Proxy.AccessLog.Syslog, "access-log-syslog", c.Proxy.AccessLog.Syslog, "syslog server (udp://host:port, tcp://host:port), empty for the local daemon")
+	fs.StringVar(&c.Proxy.AccessLog.SyslogTag, "access-log-syslog-tag", c.Proxy.AccessLog.SyslogTag, "syslog tag of access records")
+
+	fs.DurationVar(&c.Proxy.BruteForce.Window, "brute-force-window", c.Proxy.BruteForce.Window, "how long a failed login counts towards a ban")
+	fs.IntVar(&c.Proxy.BruteForce.IPThreshold, "brute-force-ip-threshold", c.Proxy.BruteForce.IPThreshold, "failed logins from one address that ban it, 0 to never ban addresses")
+	fs.IntVar(&c.Proxy.BruteForce.UserThreshold, "brute-force-user-threshold", c.Proxy.BruteForce.UserThreshold, "failed logins against one username that ban it, 0 to never ban usernames")
+	fs.DurationVar(&c.Proxy.BruteForce.BanDuration, "brute-force-ban-duration", c.Proxy.BruteForce.BanDuration, "how long a ban lasts")
+	fs.DurationVar(&c.Proxy.BruteForce.Backoff, "brute-force-backoff", c.Proxy.BruteForce.Backoff, "delay of the reply to a failed login, doubled for each further one, 0 for none")
+	fs.DurationVar(&c.Proxy.BruteForce.MaxBackoff, "brute-force-max-backoff", c.Proxy.BruteForce.MaxBackoff, "longest delay of the reply to a failed login")
+	fs.Var((*listValue)(&c.Proxy.BruteForce.Allowlist), "brute-force-allowlist", "comma-separated CIDRs or IPs that are never delayed nor banned")
+	return fs
+}
+
+// loadFile reads the YAML config file over the current values. Unknown keys
+// are rejected so typos do not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(name, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{name}, args...)...))
+	}
+
+	if c.Database.Host == "" {
+		invalid("database.host", "must not be empty")
+	}
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		invalid("database.port", "must be between 1 and 65535, got %d", c.Database.Port)
+	}
+	if c.Database.User == "" {
+		invalid("database.user", "must not be empty")
+	}
+	if c.Database.Name == "" {
+		invalid("database.name", "must not be empty")
+	}
+
+	c.listeners = nil
+	if len(c.Proxy.Listeners) == 0 {
+		if _, _, err := net.SplitHostPort(c.Proxy.Listen); err != nil {
+			invalid("proxy.listen", "%v", err)
+		} else {
+			listener, _ := parseListener(ListenerConfig{Name: "default", Address: c.Proxy.Listen})
+			c.listeners = append(c.listeners, listener)
+		}
+	}
+	names := make(map[string]bool)
+	sockets := make(map[string]bool)
+	for _, lc := range c.Proxy.Listeners {
+		listener, err := parseListener(lc)
+		if err != nil {
+			invalid("proxy.listeners", "%v", err)
+			continue
+		}
+		if names[listener.Name] {
+			invalid("proxy.listeners", "duplicate listener name %q", listener.Name)
+			continue
+		}
+		if sockets[listener.key()] {
+			invalid("proxy.listeners", "listener %s: %s is already used by another listener", listener.Name, listener.key())
+			continue
+		}
+		names[listener.Name] = true
+		sockets[listener.key()] = true
+		c.listeners = append(c.listeners, listener)
+	}
+	if err := c.logLevel.UnmarshalText([]byte(c.Proxy.LogLevel)); err != nil {
+		invalid("proxy.logLevel", "unknown level %q", c.Proxy.LogLevel)
+	}
+	if c.Proxy.RateLimit <= 0 {
+		invalid("proxy.rateLimit", "must be positive, got %d", c.Proxy.RateLimit)
+	}
+	if c.Proxy.BurstLimit < PROXY_BUFFER_SIZE {
+		invalid("proxy.burstLimit", "must be at least %d bytes, got %d", PROXY_BUFFER_SIZE, c.Proxy.BurstLimit)
+	}
+	if c.Proxy.GlobalRateLimit < 0 {
+		invalid("proxy.globalRateLimit", "must not be negative, got %d", c.Proxy.GlobalRateLimit)
+	}
+	if c.Proxy.DialTimeout <= 0 {
+		invalid("proxy.dialTimeout", "must be positive, got %s", c.Proxy.DialTimeout)
+	}
+	if c.Proxy.HandshakeTimeout <= 0 {
+		invalid("proxy.handshakeTimeout", "must be positive, got %s", c.Proxy.HandshakeTimeout)
+	}
+	if c.Proxy.IdleTimeout < 0 {
+		invalid("proxy.idleTimeout", "must not be negative, got %s", c.Proxy.IdleTimeout)
+	}
+	if c.Proxy.MaxSessionDuration < 0 {
+		invalid("proxy.maxSessionDuration", "must not be negative, got %s", c.Proxy.MaxSessionDuration)
+	}
+	if c.Proxy.DrainTimeout < 0 {
+		invalid("proxy.drainTimeout", "must not be negative, got %s", c.Proxy.DrainTimeout)
+	}
+	if c.Proxy.DNSTimeout <= 0 {
+		invalid("proxy.dnsTimeout", "must be positive, got %s", c.Proxy.DNSTimeout)
+	}
+	for _, raw := range c.Proxy.DNSUpstreams {
+		if _, err := ParseUpstream(raw); err != nil {
+			invalid("proxy.dnsUpstreams", "%v", err)
+		}
+	}
+	c.chain = nil
+	for _, raw := range c.Proxy.UpstreamProxies {
+		hop, err := ParseProxyHop(raw)
+		if err != nil {
+			invalid("proxy.upstreamProxies", "%v", err)
+			continue
+		}
+		c.chain = append(c.chain, hop)
+	}
+	if c.Proxy.Socks4Separator == "" {
+		invalid("proxy.socks4Separator", "must not be empty")
+	}
+	if c.Proxy.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(c.Proxy.MetricsListen); err != nil {
+			invalid("proxy.metricsListen", "%v", err)
+		}
+	}
+	if c.Proxy.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(c.Proxy.AdminListen); err != nil {
+			invalid("proxy.adminListen", "%v", err)
+		}
+	}
+	c.Proxy.AccessLog.validate(invalid)
+	c.Proxy.BruteForce.validate(invalid)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%v", errors.Join(errs...))
+	}
+	return nil
+}
+
+// DSN returns the MySQL data source name
+func (c *Config) DSN() string {
+	dsn := mysql.NewConfig()
+	dsn.User = c.Database.User
+	dsn.Passwd = c.Database.Password
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(c.Database.Host, strconv.Itoa(c.Database.Port))
+	dsn.DBName = c.Database.Name
+	dsn.ParseTime = true
+	return dsn.FormatDSN()
+}
+
+// applyEnv sets every flag that has a matching environment variable
+func applyEnv(fs *flag.FlagSet, prefix string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %v", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// readSecretFile reads a secret such as a password from a file, ignoring a
+// trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// listValue is a comma-separated flag bound to a string slice. Setting it
+// replaces the list rather than appending to it.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
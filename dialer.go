@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// Overall deadline for establishing an outbound connection
+	DIAL_TIMEOUT = 10 * time.Second
+
+	// Connection Attempt Delay from RFC 8305 section 5
+	DIAL_ATTEMPT_DELAY = 250 * time.Millisecond
+)
+
+var (
+	// errNoAddresses is returned when there is nothing to dial
+	errNoAddresses = errors.New("no addresses to dial")
+
+	// errNoEgressAddress is returned when the user's egress pool has no
+	// source address of any of the destination's families
+	errNoEgressAddress = errors.New("no egress address for destination address family")
+)
+
+// Dialer establishes outbound TCP connections using Happy Eyeballs
+// (RFC 8305): resolved addresses are interleaved by family, starting with
+// IPv6, and a new attempt is started every AttemptDelay (or as soon as the
+// previous one fails) until one of them connects.
+//
+// When Chain is set, every connection is tunnelled through those parent
+// proxies instead of being dialed directly.
+type Dialer struct {
+	Resolver     Resolver      // Resolves host names passed to DialContext
+	Chain        []ProxyHop    // Optional parent proxies, in order
+	Timeout      time.Duration // Deadline for the whole dial, across all attempts
+	AttemptDelay time.Duration // Delay before starting the next attempt
+
+	// OnDial, when set, is called after every DialAddress and Dial with the
+	// time taken and the result
+	OnDial func(elapsed time.Duration, err error)
+}
+
+// DialContext resolves address and dials it. It satisfies the signature
+// expected by http.Transport.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.DialAddress(ctx, address, nil)
+}
+
+// DialAddress resolves a host:port address and dials it from the egress
+// pool's source addresses, if any
+func (d *Dialer) DialAddress(ctx context.Context, address string, egress *EgressPool) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialAddress(ctx, address, egress)
+	d.observe(start, err)
+	return conn, err
+}
+
+func (d *Dialer) dialAddress(ctx context.Context, address string, egress *EgressPool) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.Chain) > 0 {
+		return d.dialChain(ctx, host, port, egress)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return d.DialIPs(ctx, []net.IP{ip}, port, egress)
+	}
+
+	ips, err := d.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialIPs(ctx, ips, port, egress)
+}
+
+// Dial connects to a destination whose addresses have already been resolved.
+// Through a chain the host name is used instead, so the exit proxy resolves it.
+func (d *Dialer) Dial(ctx context.Context, host string, ips []net.IP, port int, egress *EgressPool) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if len(d.Chain) > 0 {
+		conn, err = d.dialChain(ctx, host, port, egress)
+	} else {
+		conn, err = d.DialIPs(ctx, ips, port, egress)
+	}
+	d.observe(start, err)
+	return conn, err
+}
+
+// observe reports a dial started at start to OnDial
+func (d *Dialer) observe(start time.Time, err error) {
+	if d.OnDial != nil {
+		d.OnDial(time.Since(start), err)
+	}
+}
+
+// UsesChain reports whether connections go through parent proxies
+func (d *Dialer) UsesChain() bool {
+	return len(d.Chain) > 0
+}
+
+// DialIPs races connection attempts to ips on port and returns the first
+// connection that succeeds. If every attempt fails, the error of the most
+// preferred address is returned. With an egress pool, each attempt is bound
+// to a source address of the destination's family and destinations of a
+// family the pool does not cover are skipped.
+func (d *Dialer) DialIPs(ctx context.Context, ips []net.IP, port int, egress *EgressPool) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errNoAddresses
+	}
+	if egress != nil {
+		var reachable []net.IP
+		for _, ip := range ips {
+			if egress.Supports(ip) {
+				reachable = append(reachable, ip)
+			}
+		}
+		if len(reachable) == 0 {
+			return nil, errNoEgressAddress
+		}
+		ips = reachable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	type dialResult struct {
+		index int // Position of the address in addrs
+		conn  net.Conn
+		err   error
+	}
+
+	addrs := sortAddresses(ips)
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+
+	startAttempt := func() {
+		dialer := &net.Dialer{}
+		if egress != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: egress.Pick(addrs[next])}
+		}
+		index := next
+		addr := net.JoinHostPort(addrs[index].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{index, conn, err}
+		}()
+	}
+
+	startAttempt()
+	delay := time.NewTimer(d.AttemptDelay)
+	defer delay.Stop()
+
+	errs := make([]error, len(addrs))
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Abort the attempts still in flight and close any that
+				// manage to connect anyway
+				cancel()
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			errs[r.index] = r.err
+
+			// A failed attempt starts the next one immediately
+			if next < len(addrs) {
+				startAttempt()
+				delay.Reset(d.AttemptDelay)
+			}
+
+		case <-delay.C:
+			if next < len(addrs) {
+				startAttempt()
+				delay.Reset(d.AttemptDelay)
+			}
+		}
+	}
+
+	// Every address was tried, the first one is the most preferred
+	return nil, errs[0]
+}
+
+// sortAddresses interleaves IPv6 and IPv4 addresses, IPv6 first, keeping the
+// resolver's order within each family (RFC 8305 section 4)
+func sortAddresses(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+// replyCodeForDialError maps an outbound dial error to a SOCKS5 reply code
+// by inspecting the underlying errno. Errors from parent proxies carry their
+// own reply code, except timeouts reaching or talking to a hop, which are
+// reported like a direct timeout.
+func replyCodeForDialError(err error) byte {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var upstreamErr *UpstreamError
+
+	switch {
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, context.DeadlineExceeded):
+		return TTL_EXPIRED
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TTL_EXPIRED
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.Code
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return HOST_UNREACHABLE
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return CONNECTION_NOT_ALLOWED
+	case errors.As(err, &dnsErr), errors.Is(err, errNoAddresses):
+		return HOST_UNREACHABLE
+	case errors.Is(err, errNoEgressAddress):
+		return NETWORK_UNREACHABLE
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return HOST_UNREACHABLE
+	}
+	return GENERAL_FAILURE
+}
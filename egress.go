@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Egress address selection modes stored in user.egressMode
+const (
+	EGRESS_ROUND_ROBIN = "round-robin"
+	EGRESS_RANDOM      = "random"
+)
+
+// EgressPool is the set of source addresses a user's outbound connections
+// are bound to. Addresses are picked per connection, by destination family,
+// either in turn or at random.
+type EgressPool struct {
+	key    string // Raw column values the pool was built from
+	ipv4   []net.IP
+	ipv6   []net.IP
+	random bool
+	next   atomic.Uint64
+
+	transportMutex  sync.Mutex
+	transport       *http.Transport // HTTP forwarding pool bound to these addresses
+	transportDialer *Dialer         // Dialer the transport was built for
+}
+
+// parseEgressPool parses a comma-separated list of source IPs and a mode
+func parseEgressPool(list, mode string) (*EgressPool, error) {
+	pool := &EgressPool{key: list + "|" + mode}
+
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", EGRESS_ROUND_ROBIN:
+	case EGRESS_RANDOM:
+		pool.random = true
+	default:
+		return nil, fmt.Errorf("unknown egress mode %q", mode)
+	}
+
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress IP %q", field)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			pool.ipv4 = append(pool.ipv4, ip4)
+		} else {
+			pool.ipv6 = append(pool.ipv6, ip)
+		}
+	}
+
+	if len(pool.ipv4) == 0 && len(pool.ipv6) == 0 {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// Pick returns the source address to use for a connection to dst, or nil if
+// the pool has no address of the same family
+func (p *EgressPool) Pick(dst net.IP) net.IP {
+	candidates := p.ipv6
+	if dst.To4() != nil {
+		candidates = p.ipv4
+	}
+	return p.pick(candidates)
+}
+
+// Supports reports whether the pool has an address of dst's family
+func (p *EgressPool) Supports(dst net.IP) bool {
+	if dst.To4() != nil {
+		return len(p.ipv4) > 0
+	}
+	return len(p.ipv6) > 0
+}
+
+// PickAny returns a source address of either family, preferring IPv4
+func (p *EgressPool) PickAny() net.IP {
+	if len(p.ipv4) > 0 {
+		return p.pick(p.ipv4)
+	}
+	return p.pick(p.ipv6)
+}
+
+func (p *EgressPool) pick(candidates []net.IP) net.IP {
+	switch {
+	case len(candidates) == 0:
+		return nil
+	case len(candidates) == 1:
+		return candidates[0]
+	case p.random:
+		return candidates[rand.IntN(len(candidates))]
+	default:
+		return candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+	}
+}
+
+// httpTransport returns the HTTP forwarding transport bound to this pool. It
+// is rebuilt when a reload replaced the dialer.
+func (p *EgressPool) httpTransport(dialer *Dialer) *http.Transport {
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	if p.transport == nil || p.transportDialer != dialer {
+		if p.transport != nil {
+			p.transport.CloseIdleConnections()
+		}
+		p.transport = newHTTPTransport(dialer, p)
+		p.transportDialer = dialer
+	}
+	return p.transport
+}
+
+// closeIdleConnections drops pooled HTTP connections bound to this pool
+func (p *EgressPool) closeIdleConnections() {
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// egressRegistry keeps one pool per user so round-robin state is shared by
+// all of the user's connections. A pool is rebuilt when the user's columns
+// change.
+type egressRegistry struct {
+	mutex sync.Mutex
+	pools map[string]*EgressPool // Maps username to egress pool
+}
+
+func newEgressRegistry() *egressRegistry {
+	return &egressRegistry{pools: make(map[string]*EgressPool)}
+}
+
+// pool returns the egress pool for a user's current egressIP and egressMode
+// values, or nil if the user has no egress addresses
+func (r *egressRegistry) pool(username, list, mode string) (*EgressPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	existing := r.pools[username]
+	if existing != nil && existing.key == list+"|"+mode {
+		return existing, nil
+	}
+
+	pool, err := parseEgressPool(list, mode)
+	if err != nil || pool == nil {
+		delete(r.pools, username)
+	} else {
+		r.pools[username] = pool
+	}
+
+	// Connections pooled for the old addresses must not be reused
+	if existing != nil {
+		existing.closeIdleConnections()
+	}
+	return pool, err
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Realm announced in Proxy-Authenticate challenges
+	HTTP_PROXY_REALM = "proxy"
+
+	// Upstream connection pool settings for plain HTTP forwarding
+	HTTP_MAX_IDLE_CONNS          = 100
+	HTTP_IDLE_CONN_TIMEOUT       = 90 * time.Second
+	HTTP_RESPONSE_HEADER_TIMEOUT = 30 * time.Second
+)
+
+// isHTTPRequestStart reports whether the first byte of a connection looks
+// like the start of an HTTP method. SOCKS versions are 0x04 and 0x05, so an
+// uppercase ASCII letter is enough to tell the protocols apart.
+func isHTTPRequestStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTP processes a connection that starts with an HTTP request.
+//
+// CONNECT requests become tunnels, absolute-URI requests are forwarded as a
+// classic HTTP/1.1 proxy. The first request authenticates the connection and
+// takes a connection slot; later keep-alive requests must present the same
+// Proxy-Authorization header. On listeners that allow anonymous access a
+// request without credentials proceeds with no user.
+func (s *ProxyServer) handleHTTP(conn *bufferedConn, l *listenerSettings) error {
+	rt := s.runtime()
+	var user *User
+	var authenticated bool
+	var authHeader string
+
+	for {
+		// The first request must arrive within the handshake deadline,
+		// later ones on a keep-alive connection within the idle timeout.
+		// A draining server closes keep-alive connections between requests.
+		if authenticated {
+			if !s.markIdle(conn) {
+				return nil
+			}
+			conn.SetReadDeadline(idleDeadline(rt.Config.Proxy.IdleTimeout))
+		}
+		req, err := http.ReadRequest(conn.reader)
+		if authenticated && !s.markBusy(conn) {
+			return nil
+		}
+		if err != nil {
+			// A keep-alive client closing or going idle between requests
+			// is not an error
+			if authenticated && (err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded)) {
+				return nil
+			}
+			return fmt.Errorf("failed to read HTTP request: %v", err)
+		}
+		conn.SetDeadline(time.Time{})
+
+		if !authenticated {
+			if user, err = s.authenticateHTTP(conn, l, req); err != nil {
+				return err
+			}
+			authenticated = true
+			authHeader = req.Header.Get("Proxy-Authorization")
+			// Forwarded requests count against the quota like tunnels do
+			s.quota.acquire(user)
+			defer s.quota.release(user)
+		} else if req.Header.Get("Proxy-Authorization") != authHeader {
+			writeHTTPError(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", HTTP_PROXY_REALM)},
+			})
+			return errors.New("proxy credentials changed on keep-alive connection")
+		}
+
+		if req.Method == http.MethodConnect {
+			return s.handleHTTPConnect(conn, rt, l, req, user)
+		}
+
+		keepAlive, err := s.handleHTTPForward(conn, rt, l, req, user)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// handleHTTPConnect dials the host of an authenticated HTTP CONNECT request
+// and tunnels the connection with proxyData
+func (s *ProxyServer) handleHTTPConnect(conn *bufferedConn, rt *runtimeConfig, l *listenerSettings, req *http.Request, user *User) error {
+	dstAddrPort := req.Host
+	host, port, err := net.SplitHostPort(dstAddrPort)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("invalid CONNECT target %q: %v", dstAddrPort, err)
+	}
+
+	// Sessions carry the SOCKS5 reply code matching the HTTP status
+	portNumber, _ := strconv.Atoi(port)
+	session := s.newSession(conn, host, portNumber)
+
+	if err := s.checkAddress(rt, user, dstAddrPort); err != nil {
+		writeHTTPError(conn, http.StatusForbidden, nil)
+		s.rejectSession(session, CONNECTION_NOT_ALLOWED)
+		return err
+	}
+
+	dstConn, err := rt.Dialer.DialAddress(req.Context(), dstAddrPort, l.egressFor(user))
+	if err != nil {
+		s.Logger.Error("Failed to connect to destination", "address", dstAddrPort, "error", err)
+		writeHTTPError(conn, httpStatusForDialError(err), nil)
+		s.rejectSession(session, replyCodeForDialError(err))
+		return err
+	}
+	defer dstConn.Close()
+	session.ResolvedIP = connectedIP(rt, dstConn)
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return err
+	}
+
+	s.proxyData(conn, dstConn, session)
+	return nil
+}
+
+// handleHTTPForward forwards a single absolute-URI request upstream and
+// writes the response back. It reports whether the client connection can be
+// reused for another request.
+func (s *ProxyServer) handleHTTPForward(conn *bufferedConn, rt *runtimeConfig, l *listenerSettings, req *http.Request, user *User) (bool, error) {
+	start := time.Now()
+	var username string
+	if user != nil {
+		username = user.Username
+	}
+	clientAddr := conn.RemoteAddr().String()
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return false, fmt.Errorf("unsupported request URI: %s", req.RequestURI)
+	}
+
+	// Each request is a session of its own, recorded like a tunnel
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	portNumber, _ := strconv.Atoi(port)
+	session := s.newSession(conn, req.URL.Hostname(), portNumber)
+
+	// Apply the access rules to the origin server
+	if err := s.checkAddress(rt, user, net.JoinHostPort(req.URL.Hostname(), port)); err != nil {
+		writeHTTPError(conn, http.StatusForbidden, nil)
+		s.rejectSession(session, CONNECTION_NOT_ALLOWED)
+		return false, err
+	}
+
+	if s.quota.exhausted(user) {
+		writeHTTPError(conn, http.StatusForbidden, nil)
+		session.ReplyCode = CONNECTION_NOT_ALLOWED
+		session.CloseReason = SESSION_CLOSE_QUOTA
+		session.EndedAt = time.Now()
+		s.finishSession(session)
+		return false, ErrQuotaExceeded
+	}
+
+	// The request and response bodies are limited like a tunnel's traffic
+	upload, download := s.sessionBandwidth(rt, user)
+	defer s.bandwidth.release(user)
+
+	// Build the upstream request, noting the address the transport connects
+	// to. The transport may read the body from another goroutine.
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			session.ResolvedIP = connectedIP(rt, info.Conn)
+		},
+	}
+	outReq := req.Clone(httptrace.WithClientTrace(req.Context(), trace))
+	outReq.RequestURI = ""
+	outReq.Close = false
+	removeHopByHopHeaders(outReq.Header)
+	var bytesUp atomic.Int64
+	if outReq.Body != nil {
+		outReq.Body = &countingReader{
+			ReadCloser: &quotaReader{
+				ReadCloser: &bandwidthReader{ReadCloser: outReq.Body, limiters: upload},
+				quota:      s.quota,
+				user:       user,
+			},
+			n: &bytesUp,
+		}
+	}
+
+	resp, err := rt.httpTransportFor(l.egressFor(user)).RoundTrip(outReq)
+	if err != nil {
+		status := httpStatusForDialError(err)
+		s.Logger.Error("HTTP request failed", "username", username, "client", clientAddr,
+			"method", req.Method, "url", req.URL.String(), "status", status, "error", err)
+		writeHTTPError(conn, status, nil)
+		s.rejectSession(session, replyCodeForDialError(err))
+		return false, err
+	}
+	defer resp.Body.Close()
+	live := sessionOf(conn)
+	live.setState(SESSION_STATE_ACTIVE)
+
+	// The session ends once the response has been relayed
+	defer func() {
+		session.BytesUp = bytesUp.Load()
+		live.addTraffic(session.BytesUp, session.BytesDown)
+		session.ReplyCode = SUCCEEDED
+		session.EndedAt = time.Now()
+		s.finishSession(session)
+	}()
+
+	// Relay the response, keeping the client connection open if it asked to
+	// and the response does not end with the upstream connection, like an
+	// HTTP/1.0 or close-delimited one, whose body the client could not tell
+	// apart from the next response
+	removeHopByHopHeaders(resp.Header)
+	resp.Close = resp.Close || req.Close
+	writer := &quotaWriter{w: &bandwidthWriter{w: conn, limiters: download}, quota: s.quota, user: user}
+	if err := resp.Write(&countingWriter{w: writer, n: &session.BytesDown}); err != nil {
+		session.CloseReason = SESSION_CLOSE_ERROR
+		if errors.Is(err, ErrQuotaExceeded) {
+			session.CloseReason = SESSION_CLOSE_QUOTA
+		}
+		return false, err
+	}
+	session.CloseReason = SESSION_CLOSE_TARGET
+
+	s.Logger.Info("HTTP request", "username", username, "client", clientAddr,
+		"method", req.Method, "url", req.URL.String(), "status", resp.StatusCode,
+		"duration", time.Since(start))
+
+	return !resp.Close, nil
+}
+
+// countingReader adds the bytes read through it to n
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter adds the bytes written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	*w.n += int64(n)
+	return n, err
+}
+
+// authenticateHTTP checks the Proxy-Authorization header with the same rules
+// as performAuth and writes the matching error response on failure. It
+// returns a nil user for an anonymous request the listener allows, and the
+// certificate user when a client certificate authenticated the connection.
+func (s *ProxyServer) authenticateHTTP(conn net.Conn, l *listenerSettings, req *http.Request) (*User, error) {
+	if user := s.connectionUser(conn); user != nil {
+		return user, nil
+	}
+
+	header := req.Header.Get("Proxy-Authorization")
+	if l.allows(AUTH_NONE) && (header == "" || !l.allows(AUTH_PASSWORD)) {
+		return nil, nil
+	}
+
+	username, password, ok := parseProxyAuthorization(header)
+	if !ok {
+		writeHTTPError(conn, http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", HTTP_PROXY_REALM)},
+		})
+		return nil, errors.New("missing proxy credentials")
+	}
+
+	user, err := s.authenticate(conn, username, password)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrMaxConnections):
+			writeHTTPError(conn, http.StatusTooManyRequests, nil)
+		case errors.Is(err, ErrQuotaExceeded):
+			writeHTTPError(conn, http.StatusForbidden, nil)
+		default:
+			writeHTTPError(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", HTTP_PROXY_REALM)},
+			})
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// parseProxyAuthorization decodes a "Basic" Proxy-Authorization header
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// hopByHopHeaders are meaningful only for a single transport-level connection
+// and must not be forwarded by proxies (RFC 7230 section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders strips hop-by-hop headers, including any listed in
+// the Connection header
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// newHTTPTransport creates the pooled transport used for plain HTTP
+// forwarding so upstream connections are kept alive across requests. Every
+// upstream connection is bound to the egress pool, if one is given.
+func newHTTPTransport(dialer *Dialer, egress *EgressPool) *http.Transport {
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialAddress(ctx, address, egress)
+		},
+		MaxIdleConns:          HTTP_MAX_IDLE_CONNS,
+		IdleConnTimeout:       HTTP_IDLE_CONN_TIMEOUT,
+		ResponseHeaderTimeout: HTTP_RESPONSE_HEADER_TIMEOUT,
+		DisableCompression:    true,
+	}
+}
+
+// httpStatusForDialError maps an outbound dial or upstream error to a
+// gateway status: 504 for timeouts, 502 for everything else. Errors from a
+// parent proxy hop are wrapped in an UpstreamError.
+func httpStatusForDialError(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeHTTPError writes a minimal HTTP/1.1 error response and asks the
+// client to close the connection
+func writeHTTPError(conn net.Conn, status int, header http.Header) error {
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Close:      true,
+	}
+	for key, values := range header {
+		resp.Header[key] = values
+	}
+	body := http.StatusText(status) + "\n"
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(strings.NewReader(body))
+
+	return resp.Write(conn)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// Front-end protocols a listener can accept
+	PROTOCOL_SOCKS5 = "socks5"
+	PROTOCOL_SOCKS4 = "socks4"
+	PROTOCOL_HTTP   = "http"
+
+	// Authentication methods a listener can accept
+	AUTH_PASSWORD = "password" // Username and password checked against the user table
+	AUTH_NONE     = "none"     // Anonymous access, only global ACL rules apply
+
+	// Client certificate mapped to the user table, TLS listeners only
+	AUTH_CERTIFICATE = "certificate"
+
+	// Delay between retries when Accept keeps failing, e.g. on EMFILE
+	ACCEPT_BACKOFF_MIN = 5 * time.Millisecond
+	ACCEPT_BACKOFF_MAX = 1 * time.Second
+)
+
+// ListenerConfig describes one client listener in the config file
+type ListenerConfig struct {
+	Name        string             `yaml:"name"`        // Label used in logs and metrics
+	Network     string             `yaml:"network"`     // tcp, tcp4, tcp6 or unix
+	Address     string             `yaml:"address"`     // host:port, or the socket path for unix
+	SocketMode  string             `yaml:"socketMode"`  // Octal permissions of a unix socket
+	Protocols   []string           `yaml:"protocols"`   // Accepted front-ends, empty for all
+	AuthMethods []string           `yaml:"authMethods"` // Accepted authentication, empty for password only
+	EgressIP    string             `yaml:"egressIP"`    // Source addresses for users without their own
+	EgressMode  string             `yaml:"egressMode"`
+	TLS         *ListenerTLSConfig `yaml:"tls"` // Wraps the listener in TLS when set
+
+	// Load balancers, as CIDRs or IPs, whose connections must start with a
+	// PROXY protocol v1 or v2 header. Empty disables PROXY protocol.
+	ProxyProtocol []string `yaml:"proxyProtocol"`
+}
+
+// listenerSettings is a validated ListenerConfig. Each connection keeps the
+// settings of its listener from the moment it was accepted.
+type listenerSettings struct {
+	ListenerConfig
+	socketMode  os.FileMode
+	protocols   map[string]bool
+	authMethods map[string]bool
+	egress      *EgressPool
+	tls         *tls.Config // nil for a plaintext listener
+
+	proxyProtocol []*net.IPNet // Sources trusted to send PROXY headers
+}
+
+// parseListener validates a listener and fills in its defaults
+func parseListener(lc ListenerConfig) (*listenerSettings, error) {
+	if lc.Network == "" {
+		lc.Network = "tcp"
+	}
+	if lc.Name == "" {
+		lc.Name = lc.Network + "://" + lc.Address
+	}
+	l := &listenerSettings{
+		protocols:   make(map[string]bool),
+		authMethods: make(map[string]bool),
+	}
+
+	switch lc.Network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(lc.Address); err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lc.Name, err)
+		}
+		if lc.SocketMode != "" {
+			return nil, fmt.Errorf("listener %s: socketMode only applies to unix sockets", lc.Name)
+		}
+	case "unix":
+		if lc.Address == "" {
+			return nil, fmt.Errorf("listener %s: missing socket path", lc.Name)
+		}
+		if lc.SocketMode != "" {
+			mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+			if err != nil || mode > 0o777 {
+				return nil, fmt.Errorf("listener %s: invalid socketMode %q", lc.Name, lc.SocketMode)
+			}
+			l.socketMode = os.FileMode(mode)
+		}
+	default:
+		return nil, fmt.Errorf("listener %s: unsupported network %q", lc.Name, lc.Network)
+	}
+
+	protocols := lc.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{PROTOCOL_SOCKS5, PROTOCOL_SOCKS4, PROTOCOL_HTTP}
+	}
+	for _, protocol := range protocols {
+		switch protocol {
+		case PROTOCOL_SOCKS5, PROTOCOL_SOCKS4, PROTOCOL_HTTP:
+			l.protocols[protocol] = true
+		default:
+			return nil, fmt.Errorf("listener %s: unknown protocol %q", lc.Name, protocol)
+		}
+	}
+
+	authMethods := lc.AuthMethods
+	if len(authMethods) == 0 {
+		authMethods = []string{AUTH_PASSWORD}
+	}
+	for _, method := range authMethods {
+		switch method {
+		case AUTH_PASSWORD, AUTH_NONE, AUTH_CERTIFICATE:
+			l.authMethods[method] = true
+		default:
+			return nil, fmt.Errorf("listener %s: unknown auth method %q", lc.Name, method)
+		}
+	}
+
+	egress, err := parseEgressPool(lc.EgressIP, lc.EgressMode)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", lc.Name, err)
+	}
+	l.egress = egress
+
+	if lc.TLS != nil {
+		if l.tls, err = parseListenerTLS(lc.TLS, l.authMethods); err != nil {
+			return nil, fmt.Errorf("listener %s: %v", lc.Name, err)
+		}
+	} else if l.authMethods[AUTH_CERTIFICATE] {
+		return nil, fmt.Errorf("listener %s: the %s auth method requires tls", lc.Name, AUTH_CERTIFICATE)
+	}
+
+	if len(lc.ProxyProtocol) > 0 {
+		if lc.Network == "unix" {
+			return nil, fmt.Errorf("listener %s: proxyProtocol is not supported on unix sockets", lc.Name)
+		}
+		if l.proxyProtocol, err = parseNetworks(lc.ProxyProtocol); err != nil {
+			return nil, fmt.Errorf("listener %s: proxyProtocol: %v", lc.Name, err)
+		}
+	}
+
+	l.ListenerConfig = lc
+	return l, nil
+}
+
+// key identifies the socket of a listener, so a reload that only changes its
+// settings keeps the socket open
+func (l *listenerSettings) key() string {
+	return l.Network + "://" + l.Address
+}
+
+// allows reports whether the listener accepts an authentication method
+func (l *listenerSettings) allows(method string) bool {
+	return l.authMethods[method]
+}
+
+// egressFor returns the egress pool for a connection: the user's own pool,
+// else the listener's, else nil for the default source address
+func (l *listenerSettings) egressFor(user *User) *EgressPool {
+	if user != nil && user.Egress != nil {
+		return user.Egress
+	}
+	return l.egress
+}
+
+// proxyListener is an open listener with its own accept loop and counters
+type proxyListener struct {
+	listener net.Listener
+	settings atomic.Pointer[listenerSettings]
+
+	accepted     atomic.Uint64 // Connections accepted
+	acceptErrors atomic.Uint64 // Failed Accept calls
+	active       atomic.Int64  // Connections currently open
+	nextClient   atomic.Uint64 // Numbers unix clients, which have no address
+}
+
+// ListenerStats is a snapshot of a listener's counters, labelled for metrics
+type ListenerStats struct {
+	Name         string
+	Network      string
+	Address      string
+	Accepted     uint64
+	AcceptErrors uint64
+	Active       int64
+}
+
+// unixConn gives each unix socket client a unique remote address, since the
+// connection bookkeeping is keyed by RemoteAddr().String()
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite half-closes the socket so proxyData can propagate EOF
+func (c *unixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// openListener binds a listener and starts its accept loop
+func (s *ProxyServer) openListener(settings *listenerSettings) (*proxyListener, error) {
+	if settings.Network == "unix" {
+		if err := removeStaleSocket(settings.Address); err != nil {
+			return nil, fmt.Errorf("listener %s: %v", settings.Name, err)
+		}
+	}
+
+	listener, err := net.Listen(settings.Network, settings.Address)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", settings.Name, err)
+	}
+
+	if settings.socketMode != 0 {
+		if err := os.Chmod(settings.Address, settings.socketMode); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("listener %s: %v", settings.Name, err)
+		}
+	}
+
+	pl := &proxyListener{listener: listener}
+	pl.settings.Store(settings)
+
+	s.acceptLoops.Add(1)
+	go func() {
+		defer s.acceptLoops.Done()
+		s.serve(pl)
+	}()
+
+	s.Logger.Info("Listening", "listener", settings.Name, "network", settings.Network,
+		"address", listener.Addr().String(), "tls", settings.tls != nil)
+	return pl, nil
+}
+
+// removeStaleSocket removes a socket file left behind by a crash, which
+// would make Listen fail. A socket is only stale if connecting to it is
+// refused; one that another process still listens on is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("address %s already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("address %s already in use: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// serve accepts connections on a listener until it is closed. Accept errors
+// are retried with exponential backoff so a full file descriptor table does
+// not turn into a busy loop.
+func (s *ProxyServer) serve(pl *proxyListener) {
+	var delay time.Duration
+	for {
+		conn, err := pl.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			pl.acceptErrors.Add(1)
+			delay = min(max(delay*2, ACCEPT_BACKOFF_MIN), ACCEPT_BACKOFF_MAX)
+			s.Logger.Error("Failed to accept connection", "listener", pl.settings.Load().Name,
+				"error", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		settings := pl.settings.Load()
+		if settings.Network == "unix" {
+			conn = &unixConn{Conn: conn, remote: &net.UnixAddr{
+				Net:  "unix",
+				Name: fmt.Sprintf("%s#%d", settings.Name, pl.nextClient.Add(1)),
+			}}
+		}
+
+		pl.accepted.Add(1)
+		pl.active.Add(1)
+		s.trackConn(conn)
+		go func() {
+			defer pl.active.Add(-1)
+			defer s.untrackConn(conn)
+			s.handleConnection(conn, settings)
+		}()
+	}
+}
+
+// updateListeners makes the open listeners match the configured ones. New
+// sockets are bound before anything is closed, and if one of them fails
+// every socket opened here is closed again and nothing changes. Listeners
+// whose socket did not change keep running with the new settings.
+// The caller must hold reloadMutex.
+func (s *ProxyServer) updateListeners(configured []*listenerSettings) error {
+	next := make(map[string]*proxyListener, len(configured))
+	var opened []*proxyListener
+
+	for _, settings := range configured {
+		if existing, ok := s.listeners[settings.key()]; ok {
+			next[settings.key()] = existing
+			continue
+		}
+
+		pl, err := s.openListener(settings)
+		if err != nil {
+			for _, pl := range opened {
+				pl.listener.Close()
+			}
+			return err
+		}
+		opened = append(opened, pl)
+		next[settings.key()] = pl
+	}
+
+	// Everything is bound, apply the settings and drop removed listeners
+	for _, settings := range configured {
+		pl := next[settings.key()]
+		if !reflect.DeepEqual(pl.settings.Load().ListenerConfig, settings.ListenerConfig) {
+			pl.settings.Store(settings)
+		}
+	}
+	for key, pl := range s.listeners {
+		if _, ok := next[key]; !ok {
+			pl.listener.Close()
+			s.Logger.Info("Stopped listening", "listener", pl.settings.Load().Name)
+		}
+	}
+
+	s.listeners = next
+	return nil
+}
+
+// closeListeners stops every accept loop. The caller must hold reloadMutex.
+func (s *ProxyServer) closeListeners() {
+	for _, pl := range s.listeners {
+		pl.listener.Close()
+	}
+	s.listeners = nil
+}
+
+// ListenerStats returns the counters of every open listener
+func (s *ProxyServer) ListenerStats() []ListenerStats {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	stats := make([]ListenerStats, 0, len(s.listeners))
+	for _, pl := range s.listeners {
+		settings := pl.settings.Load()
+		stats = append(stats, ListenerStats{
+			Name:         settings.Name,
+			Network:      settings.Network,
+			Address:      pl.listener.Addr().String(),
+			Accepted:     pl.accepted.Load(),
+			AcceptErrors: pl.acceptErrors.Load(),
+			Active:       pl.active.Load(),
+		})
+	}
+	return stats
+}
@@ -3,20 +3,25 @@ package main
 import (
 	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"golang.org/x/time/rate"
 )
 
 const (
@@ -49,6 +54,18 @@ const (
 	COMMAND_NOT_SUPPORTED    = 0x07
 	ADDRESS_TYPE_UNSUPPORTED = 0x08
 
+	// How long a BIND request waits for the inbound connection
+	BIND_ACCEPT_TIMEOUT = 2 * time.Minute
+
+	// Default deadline for a client to negotiate, authenticate and send its
+	// request, overridden by proxy.handshakeTimeout
+	HANDSHAKE_TIMEOUT = 30 * time.Second
+
+	// Default time a tunnel may carry no data in either direction, overridden
+	// by proxy.idleTimeout
+	IDLE_TIMEOUT = 10 * time.Minute
+
+	// Default rate limiting, overridden by proxy.rateLimit and proxy.burstLimit
 	// Rate limiting (100 KB/s) - Tạm thời vô hiệu hóa giới hạn băng thông
 	// RATE_LIMIT  = 100 * 1024 * 1024 // bytes per second
 	// BURST_LIMIT = 1024 * 1024       // burst size
@@ -57,37 +74,72 @@ const (
 	BURST_LIMIT = 100 * 1024 * 1024  // 100 MB burst - thực tế là không giới hạn
 )
 
+// Authentication errors shared by all protocol front-ends
+var (
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrAuthUnavailable = errors.New("user lookup failed")
+	ErrMaxConnections  = errors.New("max connections reached")
+)
+
 // User credentials for authentication
 type User struct {
 	Username      string
 	Password      string
 	MaxConnection int
+	Egress        *EgressPool   // Source addresses for outbound connections, nil for the default
+	UploadRate    int64         // Bytes per second shared by all sessions, 0 for unlimited
+	DownloadRate  int64         // Bytes per second shared by all sessions, 0 for unlimited
+	BytesAllowed  int64         // Traffic quota per period in bytes, 0 for unlimited
+	BytesUsed     int64         // Traffic used in the current period, as stored in the database
+	QuotaPeriod   string        // When BytesUsed resets: daily, monthly or never
+	QuotaResetAt  time.Time     // Start of the current period, zero if never reset
+	MaxSession    time.Duration // Longest a session may last, 0 for the server default
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 }
 
 // ProxyServer represents our SOCKS5 proxy server
 type ProxyServer struct {
-	Addr            string
-	Logger          *slog.Logger
-	DB              *sql.DB
-	mutex           sync.RWMutex
-	connections     map[string]string // Maps client address to authenticated username
-	userConnections map[string]int    // Maps username to number of active connections
-	connMutex       sync.RWMutex
+	Logger     *slog.Logger
+	DB         *sql.DB
+	mutex      sync.RWMutex
+	registry   *SessionRegistry   // Live client connections and their users
+	egress     *egressRegistry    // Per-user source address pools and HTTP transports
+	bandwidth  *bandwidthRegistry // Per-user and server-wide bandwidth limits shared by sessions
+	quota      *quotaRegistry     // Traffic counted against user quotas, saved in batches
+	sessionLog *sessionWriter     // Finished sessions waiting for the session table
+	accessLog  *accessLog         // One record per finished session, nil when disabled
+	ACL        *ACL               // Destination access rules checked before dialing
+	metrics    *proxyMetrics      // Prometheus metrics, served on proxy.metricsListen
+	bruteForce *bruteForceGuard   // Failed logins and bans, by client address and username
+
+	settings    atomic.Pointer[runtimeConfig] // Swapped on reload, see runtime()
+	logLevel    *slog.LevelVar
+	reloadMutex sync.Mutex                // Serializes reloads and guards listeners
+	listeners   map[string]*proxyListener // Open listeners by socket, nil once stopped
+	acceptLoops sync.WaitGroup            // Counts running accept loops
+
+	activeMutex sync.Mutex
+	active      map[net.Conn]struct{} // Client connections in flight, closed on forced shutdown
+	idle        map[net.Conn]struct{} // Keep-alive connections between requests, closed when draining starts
+	draining    chan struct{}         // Closed once Start stops accepting
+	sessions    sync.WaitGroup        // Counts in-flight connections for draining
 }
 
-// NewProxyServer creates a new SOCKS5 proxy server
-func NewProxyServer(addr string) *ProxyServer {
+// NewProxyServer creates a new SOCKS5 proxy server from a validated config
+func NewProxyServer(cfg *Config) *ProxyServer {
 	// Setup logger - chỉ log ra console
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(cfg.logLevel)
 	logOpts := &slog.HandlerOptions{
-		Level: slog.LevelDebug,
+		Level: logLevel,
 	}
 	logHandler := slog.NewTextHandler(os.Stdout, logOpts)
 	logger := slog.New(logHandler)
+	slog.SetDefault(logger)
 
 	// Connect to MySQL database
-	db, err := sql.Open("mysql", "root:Tuan123@tcp(127.0.0.1:3306)/proxy")
+	db, err := sql.Open("mysql", cfg.DSN())
 	if err != nil {
 		logger.Error("Failed to connect to database", "error", err)
 		os.Exit(1)
@@ -101,81 +153,239 @@ func NewProxyServer(addr string) *ProxyServer {
 
 	logger.Info("Connected to MySQL database")
 
+	// Load destination access rules. Starting without them would allow
+	// every destination, so a failed load is fatal.
+	acl := NewACL()
+	if err := acl.Load(db); err != nil {
+		logger.Error("Failed to load ACL rules", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Loaded ACL rules", "rules", acl.Len())
+
+	accessLog, err := openAccessLog(cfg.Proxy.AccessLog)
+	if err != nil {
+		logger.Error("Failed to open access log", "error", err)
+		os.Exit(1)
+	}
+
 	// Create server
-	return &ProxyServer{
-		Addr:            addr,
-		Logger:          logger,
-		DB:              db,
-		connections:     make(map[string]string),
-		userConnections: make(map[string]int),
+	metrics := newProxyMetrics()
+	rt, err := newRuntimeConfig(cfg, nil, metrics)
+	if err != nil {
+		logger.Error("Failed to apply configuration", "error", err)
+		os.Exit(1)
 	}
+	server := &ProxyServer{
+		Logger:     logger,
+		DB:         db,
+		registry:   NewSessionRegistry(),
+		egress:     newEgressRegistry(),
+		bandwidth:  newBandwidthRegistry(cfg.Proxy.GlobalRateLimit),
+		quota:      newQuotaRegistry(),
+		sessionLog: newSessionWriter(db, logger),
+		accessLog:  accessLog,
+		ACL:        acl,
+		metrics:    metrics,
+		bruteForce: newBruteForceGuard(cfg.Proxy.BruteForce),
+		logLevel:   logLevel,
+		active:     make(map[net.Conn]struct{}),
+		idle:       make(map[net.Conn]struct{}),
+		draining:   make(chan struct{}),
+	}
+	server.settings.Store(rt)
+	metrics.registry.MustRegister(&serverCollector{server: server})
+	return server
 }
 
-// Start starts the proxy server
-func (s *ProxyServer) Start() error {
-	listener, err := net.Listen("tcp", s.Addr)
+// Start accepts connections until ctx is cancelled. It then stops accepting
+// and returns; call Shutdown to drain the sessions still in flight.
+func (s *ProxyServer) Start(ctx context.Context) error {
+	s.reloadMutex.Lock()
+	err := s.updateListeners(s.runtime().Config.listeners)
+	s.reloadMutex.Unlock()
 	if err != nil {
 		return err
 	}
-	defer listener.Close()
-	defer s.DB.Close()
+
+	if err := s.serveInternal(ctx); err != nil {
+		s.reloadMutex.Lock()
+		s.closeListeners()
+		s.reloadMutex.Unlock()
+		return err
+	}
 
 	// s.Logger.Info("SOCKS5 proxy server started", "address", s.Addr)
 
-	for {
-		conn, err := listener.Accept()
+	// Pick up rule and bandwidth changes without a restart
+	go s.watchACL(ctx)
+	go s.watchBandwidth(ctx)
+	go s.watchQuota(ctx)
+
+	<-ctx.Done()
+
+	// Stop accepting; a reload can no longer open a listener either
+	s.reloadMutex.Lock()
+	s.closeListeners()
+	s.reloadMutex.Unlock()
+	s.startDrain()
+
+	s.acceptLoops.Wait()
+	return nil
+}
+
+// serveInternal opens the metrics and admin listeners that are configured.
+// Both stop when ctx is cancelled.
+func (s *ProxyServer) serveInternal(ctx context.Context) error {
+	proxy := s.runtime().Config.Proxy
+	if proxy.MetricsListen != "" {
+		if err := s.serveMetrics(ctx, proxy.MetricsListen); err != nil {
+			return err
+		}
+	}
+	if proxy.AdminListen != "" {
+		if err := s.serveAdmin(ctx, proxy.AdminListen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleConnection processes a client connection accepted on a listener
+func (s *ProxyServer) handleConnection(conn net.Conn, l *listenerSettings) {
+	// Behind a load balancer the client address comes from the PROXY header
+	if l.trustsProxyHeader(conn) {
+		proxied, err := readProxyHeader(conn)
 		if err != nil {
-			s.Logger.Error("Failed to accept connection", "error", err)
-			continue
+			s.Logger.Error("PROXY protocol failed", "peer", conn.RemoteAddr().String(), "listener", l.Name, "error", err)
+			s.metrics.reject(REJECT_HANDSHAKE)
+			conn.Close()
+			return
 		}
+		conn = proxied
+	}
 
-		go s.handleConnection(conn)
+	// Addresses banned for guessing passwords are dropped before any handshake
+	if s.bruteForce.bannedAddress(clientIP(conn)) {
+		s.Logger.Debug("Connection from banned address dropped", "client", conn.RemoteAddr().String(), "listener", l.Name)
+		s.metrics.reject(REJECT_BANNED)
+		conn.Close()
+		return
+	}
+
+	// TLS listeners run the same protocols inside the TLS session
+	if l.tls != nil {
+		conn = tls.Server(conn, l.tls)
 	}
-}
 
-// handleConnection processes a client connection
-func (s *ProxyServer) handleConnection(conn net.Conn) {
 	clientAddr := conn.RemoteAddr().String()
 
-	// Cleanup connection data when done
+	// The session holds the user's connection slot until the handler returns
+	session := s.registry.Register(conn, l.Name)
 	defer func() {
 		conn.Close()
-		// Lưu ý: Việc giảm số lượng kết nối đã được xử lý trong hàm proxyData
-		// Chỉ xóa kết nối khỏi map nếu chưa được xử lý bởi proxyData
-		s.connMutex.Lock()
-		_, exists := s.connections[clientAddr]
-		if exists {
-			// Kết nối vẫn còn trong map, có thể do lỗi xảy ra trước khi proxyData được gọi
-			// hoặc proxyData không được gọi (ví dụ: lỗi xác thực)
-			username := s.connections[clientAddr]
-			// Decrease connection count for this user
-			s.userConnections[username]--
-			// s.Logger.Info("Connection closed in handleConnection, decreasing count", "username", username, "connections", s.userConnections[username])
-			if s.userConnections[username] <= 0 {
-				delete(s.userConnections, username)
-			}
-			delete(s.connections, clientAddr)
-		}
-		s.connMutex.Unlock()
+		s.registry.Unregister(session)
 	}()
 
 	// s.Logger.Info("New connection", "client", clientAddr)
 
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshakeTLS(tlsConn, l); err != nil {
+			s.Logger.Error("TLS handshake failed", "client", clientAddr, "listener", l.Name, "error", err)
+			s.metrics.reject(REJECT_HANDSHAKE)
+			return
+		}
+		if err := s.authenticateCertificate(tlsConn, l, session); err != nil {
+			// Database failures are logged by authenticateCertificate and
+			// are not counted as rejected logins
+			if errors.Is(err, ErrAuthUnavailable) {
+				return
+			}
+			s.Logger.Warn("Client certificate rejected", "client", clientAddr, "listener", l.Name, "error", err)
+			if !isAuthError(err) {
+				s.metrics.reject(REJECT_AUTH)
+			}
+			return
+		}
+	}
+
+	// A client that sends nothing must not hold the connection forever. The
+	// handlers clear the deadline once the request has been read.
+	conn.SetDeadline(time.Now().Add(s.runtime().Config.Proxy.HandshakeTimeout))
+
+	// Detect the protocol from the first byte without consuming it
+	bconn := newBufferedConn(conn)
+	bconn.session = session
+	version, err := bconn.Peek(1)
+	if err != nil {
+		s.logHandlerError("Handshake failed", session, err)
+		s.metrics.reject(REJECT_HANDSHAKE)
+		return
+	}
+
+	protocol := PROTOCOL_SOCKS5
+	switch {
+	case version[0] == SOCKS4_VERSION:
+		protocol = PROTOCOL_SOCKS4
+	case isHTTPRequestStart(version[0]):
+		protocol = PROTOCOL_HTTP
+	}
+	if !l.protocols[protocol] {
+		s.Logger.Warn("Protocol not enabled on listener", "client", clientAddr,
+			"listener", l.Name, "protocol", protocol)
+		s.metrics.reject(REJECT_HANDSHAKE)
+		return
+	}
+
+	// SOCKS4 and SOCKS4a clients share the listener
+	if protocol == PROTOCOL_SOCKS4 {
+		if err := s.handleSocks4(bconn, l); err != nil {
+			s.logHandlerError("Request failed", session, err)
+		}
+		return
+	}
+
+	// HTTP CONNECT clients share the listener as well
+	if protocol == PROTOCOL_HTTP {
+		if err := s.handleHTTP(bconn, l); err != nil {
+			s.logHandlerError("Request failed", session, err)
+		}
+		return
+	}
+	conn = bconn
+
 	// Perform SOCKS5 handshake
-	if err := s.handleHandshake(conn); err != nil {
-		s.Logger.Error("Handshake failed", "client", clientAddr, "error", err)
+	if err := s.handleHandshake(conn, l); err != nil {
+		s.logHandlerError("Handshake failed", session, err)
+		// Authentication failures were counted by authenticate
+		if !isAuthError(err) {
+			s.metrics.reject(REJECT_HANDSHAKE)
+		}
 		return
 	}
 
 	// Process client request
-	if err := s.handleRequest(conn); err != nil {
-		s.Logger.Error("Request failed", "client", clientAddr, "error", err)
+	if err := s.handleRequest(conn, l); err != nil {
+		s.logHandlerError("Request failed", session, err)
+		return
+	}
+}
+
+// logHandlerError logs why a connection handler gave up. A client that did
+// not finish its handshake and request in time is logged as a timeout.
+func (s *ProxyServer) logHandlerError(msg string, session *LiveSession, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) && session.Info().State == SESSION_STATE_HANDSHAKE {
+		s.Logger.Warn("Handshake timed out", "client", session.Client,
+			"timeout", s.runtime().Config.Proxy.HandshakeTimeout)
 		return
 	}
+	s.Logger.Error(msg, "client", session.Client, "error", err)
 }
 
-// handleHandshake performs the SOCKS5 handshake
-func (s *ProxyServer) handleHandshake(conn net.Conn) error {
+// handleHandshake performs the SOCKS5 handshake, offering the methods the
+// listener allows. Username/password wins when the client offers both. A
+// connection already authenticated by its client certificate skips RFC 1929
+// and is offered no authentication only.
+func (s *ProxyServer) handleHandshake(conn net.Conn, l *listenerSettings) error {
 	// Read the SOCKS version and number of authentication methods
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
@@ -197,10 +407,17 @@ func (s *ProxyServer) handleHandshake(conn net.Conn) error {
 
 	// Check if username/password authentication is supported
 	var methodSelected byte = NO_ACCEPTABLE_METHODS
+	certificate := s.connectionUser(conn) != nil
 	for _, method := range methods {
-		if method == USERNAME_PASSWORD_AUTH {
+		switch {
+		case certificate:
+			if method == NO_AUTH {
+				methodSelected = NO_AUTH
+			}
+		case method == USERNAME_PASSWORD_AUTH && l.allows(AUTH_PASSWORD):
 			methodSelected = USERNAME_PASSWORD_AUTH
-			break
+		case method == NO_AUTH && l.allows(AUTH_NONE) && methodSelected == NO_ACCEPTABLE_METHODS:
+			methodSelected = NO_AUTH
 		}
 	}
 
@@ -215,6 +432,11 @@ func (s *ProxyServer) handleHandshake(conn net.Conn) error {
 		return errors.New("no acceptable authentication methods")
 	}
 
+	// Anonymous clients go straight to the request
+	if methodSelected == NO_AUTH {
+		return nil
+	}
+
 	// Perform username/password authentication
 	return s.performAuth(conn)
 }
@@ -262,62 +484,153 @@ func (s *ProxyServer) performAuth(conn net.Conn) error {
 	}
 
 	// Verify credentials
-	usernameStr := string(username)
-	passwordStr := string(password)
-	hashedPassword := MD5Hash(passwordStr)
+	var authStatus byte = 0x00 // Success
+	_, authErr := s.authenticate(conn, string(username), string(password))
+	if authErr != nil {
+		authStatus = 0x01 // Failure
+	}
 
-	// Query the database for user credentials
-	var user User
-	query := "SELECT username, password, maxConnection FROM user WHERE username = ?"
-	err := s.DB.QueryRow(query, usernameStr).Scan(&user.Username, &user.Password, &user.MaxConnection)
-
-	var authStatus byte = 0x01 // Failure by default
-	if err == nil && user.Password == hashedPassword {
-		// Check if user has reached max connections
-		clientAddr := conn.RemoteAddr().String()
-		s.connMutex.Lock()
-		currentConnections := s.userConnections[usernameStr]
-
-		if currentConnections >= user.MaxConnection {
-			s.Logger.Warn("Max connections reached", "username", usernameStr,
-				"current", currentConnections, "max", user.MaxConnection)
-			s.connMutex.Unlock()
-
-			// Send auth failure response
-			response := []byte{0x01, 0x01} // Auth failure
-			conn.Write(response)
-			return errors.New("max connections reached")
+	// Send auth response
+	response := []byte{0x01, authStatus}
+	if _, err := conn.Write(response); err != nil {
+		return err
+	}
+
+	return authErr
+}
+
+// authenticate verifies a username/password pair against the user table and,
+// on success, registers the connection against the user's maxConnection limit.
+// It is shared by every protocol front-end so they all enforce the same rules.
+func (s *ProxyServer) authenticate(conn net.Conn, usernameStr, passwordStr string) (*User, error) {
+	// A banned address or username is refused like a wrong password, without
+	// checking the password, so that guesses during the ban learn nothing
+	ip := clientIP(conn)
+	if s.bruteForce.banned(ip, usernameStr) {
+		s.metrics.reject(REJECT_BANNED)
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, ErrBanned)
+	}
+
+	user, err := s.verifyCredentials(usernameStr, passwordStr)
+	if err != nil {
+		// A database failure says nothing about the password, and is counted
+		// by the auth query metrics rather than as a rejected login
+		if !errors.Is(err, ErrAuthUnavailable) {
+			s.metrics.reject(REJECT_AUTH)
+			s.authFailed(conn, ip, usernameStr)
 		}
+		return nil, err
+	}
+	s.bruteForce.succeed(usernameStr)
 
-		// Authentication successful
-		authStatus = 0x00 // Success
-		// s.Logger.Info("Authentication successful", "username", usernameStr)
+	if err := s.registerConnection(sessionOf(conn), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
-		// Store the authenticated username for this connection and increment counter
-		s.connections[clientAddr] = usernameStr
-		s.userConnections[usernameStr] = currentConnections + 1
-		// s.Logger.Info("Connection established", "username", usernameStr,
-		// 	"connections", s.userConnections[usernameStr], "max", user.MaxConnection)
-		s.connMutex.Unlock()
-	} else {
-		// s.Logger.Warn("Authentication failed", "username", usernameStr, "error", err)
+// authFailed records a wrong password and holds the reply back, longer with
+// every failure of the address or username
+func (s *ProxyServer) authFailed(conn net.Conn, ip net.IP, usernameStr string) {
+	delay, bans := s.bruteForce.fail(ip, usernameStr)
+	for _, ban := range bans {
+		s.Logger.Warn("Banned after repeated authentication failures", ban.Kind, ban.Key,
+			"failures", ban.Failures, "until", ban.Until)
 	}
+	if delay > 0 {
+		s.Logger.Debug("Delaying authentication failure", "client", conn.RemoteAddr().String(),
+			"username", usernameStr, "delay", delay)
+		time.Sleep(delay)
+	}
+}
 
-	// Send auth response
-	response := []byte{0x01, authStatus}
-	if _, err := conn.Write(response); err != nil {
+// registerConnection counts an authenticated session against the user's
+// maxConnection limit and remembers the user for the session. Users who
+// have used up their traffic quota are refused.
+func (s *ProxyServer) registerConnection(session *LiveSession, user *User) error {
+	if err := s.quota.check(user); err != nil {
+		s.Logger.Warn("Traffic quota exhausted", "username", user.Username, "allowed", user.BytesAllowed)
+		s.metrics.reject(REJECT_QUOTA)
 		return err
 	}
 
-	if authStatus != 0x00 {
-		return errors.New("authentication failed")
+	if err := s.registry.Authenticate(session, user); err != nil {
+		if errors.Is(err, ErrMaxConnections) {
+			s.Logger.Warn("Max connections reached", "username", user.Username,
+				"current", s.registry.Count(user.Username), "max", user.MaxConnection)
+			s.metrics.reject(REJECT_MAX_CONNECTIONS)
+		}
+		return err
 	}
 
+	// Authentication successful
+	// s.Logger.Info("Authentication successful", "username", usernameStr)
+
 	return nil
 }
 
+// connectionUser returns the user authenticated on conn, or nil
+func (s *ProxyServer) connectionUser(conn net.Conn) *User {
+	return sessionOf(conn).User()
+}
+
+// verifyCredentials checks a username/password pair against the user table
+// without touching the connection bookkeeping
+func (s *ProxyServer) verifyCredentials(usernameStr, passwordStr string) (*User, error) {
+	hashedPassword := MD5Hash(passwordStr)
+
+	user, err := s.lookupUser(usernameStr)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %w: %v", ErrAuthFailed, ErrAuthUnavailable, err)
+	}
+	if err != nil || user.Password != hashedPassword {
+		// s.Logger.Warn("Authentication failed", "username", usernameStr, "error", err)
+		return nil, ErrAuthFailed
+	}
+	return user, nil
+}
+
+// lookupUser loads a user and their egress pool from the user table
+func (s *ProxyServer) lookupUser(usernameStr string) (*User, error) {
+	// Query the database for user credentials
+	var user User
+	var egressIP, egressMode sql.NullString
+	var quotaResetAt sql.NullTime
+	var maxSessionSeconds int64
+	query := "SELECT username, password, maxConnection, egressIP, egressMode, uploadRate, downloadRate, " +
+		"bytesAllowed, bytesUsed, quotaPeriod, quotaResetAt, maxSessionSeconds FROM user WHERE username = ?"
+	start := time.Now()
+	err := s.DB.QueryRow(query, usernameStr).Scan(&user.Username, &user.Password, &user.MaxConnection, &egressIP, &egressMode,
+		&user.UploadRate, &user.DownloadRate, &user.BytesAllowed, &user.BytesUsed, &user.QuotaPeriod, &quotaResetAt,
+		&maxSessionSeconds)
+	// An unknown user is a successful query
+	if errors.Is(err, sql.ErrNoRows) {
+		s.metrics.observeAuthQuery(time.Since(start), nil)
+	} else {
+		s.metrics.observeAuthQuery(time.Since(start), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.QuotaResetAt = quotaResetAt.Time
+	user.MaxSession = time.Duration(maxSessionSeconds) * time.Second
+
+	// Resolve the user's egress pool, shared by all of their connections. A
+	// broken pool refuses the login rather than sending the user's traffic
+	// from the server's default address
+	user.Egress, err = s.egress.pool(user.Username, egressIP.String, egressMode.String)
+	if err != nil {
+		s.Logger.Error("Invalid egress configuration", "username", user.Username, "error", err)
+		return nil, fmt.Errorf("invalid egress configuration: %v", err)
+	}
+
+	return &user, nil
+}
+
 // handleRequest processes the client's connection request
-func (s *ProxyServer) handleRequest(conn net.Conn) error {
+func (s *ProxyServer) handleRequest(conn net.Conn, l *listenerSettings) error {
+	rt := s.runtime()
+
 	// Read request header
 	buf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, buf); err != nil {
@@ -333,8 +646,8 @@ func (s *ProxyServer) handleRequest(conn net.Conn) error {
 		return fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
 
-	// Only support CONNECT command
-	if command != CONNECT {
+	// Only support CONNECT, BIND and UDP ASSOCIATE commands
+	if command != CONNECT && command != BIND && command != UDP {
 		s.sendReply(conn, COMMAND_NOT_SUPPORTED, nil)
 		return fmt.Errorf("unsupported command: %d", command)
 	}
@@ -342,6 +655,7 @@ func (s *ProxyServer) handleRequest(conn net.Conn) error {
 	// Parse the destination address based on address type
 	var dstAddr string
 	var dstIP net.IP
+	var dstIPs []net.IP
 
 	switch addrType {
 	case IPV4_ADDRESS:
@@ -373,80 +687,96 @@ func (s *ProxyServer) handleRequest(conn net.Conn) error {
 		}
 		dstAddr = string(domain)
 
+	default:
+		s.sendReply(conn, ADDRESS_TYPE_UNSUPPORTED, nil)
+		return fmt.Errorf("unsupported address type: %d", addrType)
+	}
+
+	// Read destination port
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return err
+	}
+	dstPort := binary.BigEndian.Uint16(portBuf)
+
+	// The request is complete, the handshake deadline no longer applies
+	conn.SetDeadline(time.Time{})
+
+	// Through an upstream chain the exit proxy resolves the name
+	if addrType == DOMAIN_ADDRESS && !rt.Dialer.UsesChain() {
 		// Resolve domain name to IP
-		ips, err := net.LookupIP(dstAddr)
+		ips, err := rt.Resolver.LookupIP(context.Background(), dstAddr)
 		if err != nil || len(ips) == 0 {
 			s.sendReply(conn, HOST_UNREACHABLE, nil)
+			if command == CONNECT {
+				s.rejectSession(s.newSession(conn, dstAddr, int(dstPort)), HOST_UNREACHABLE)
+			}
 			return fmt.Errorf("failed to resolve domain %s: %v", dstAddr, err)
 		}
 
-		// Use the first resolved IP
+		// Keep every resolved IP for the dialer, the first one stands in
+		// for the destination until a connection is established
+		dstIPs = ips
 		dstIP = ips[0]
+	}
+	if dstIPs == nil && dstIP != nil {
+		dstIPs = []net.IP{dstIP}
+	}
 
-		// Get the authenticated username for this connection
-		clientAddr := conn.RemoteAddr().String()
-		s.connMutex.RLock()
-		_, exists := s.connections[clientAddr]
-		s.connMutex.RUnlock()
-
-		if exists {
-			// s.Logger.Info("Domain resolved", "domain", dstAddr, "ip", dstIP.String(), "user", username)
-		} else {
-			// s.Logger.Info("Domain resolved", "domain", dstAddr, "ip", dstIP.String(), "user", "unknown")
-		}
+	// BIND waits for an inbound connection instead of dialing out
+	if command == BIND {
+		return s.handleBind(conn, rt, dstIP, dstPort, func(replyCode byte, bindAddr *net.TCPAddr) error {
+			return s.sendReply(conn, replyCode, bindAddr)
+		})
+	}
 
-	default:
-		s.sendReply(conn, ADDRESS_TYPE_UNSUPPORTED, nil)
-		return fmt.Errorf("unsupported address type: %d", addrType)
+	// UDP ASSOCIATE sets up a datagram relay for the lifetime of this connection
+	if command == UDP {
+		return s.handleUDPAssociate(conn, rt, l, dstIP, dstPort)
 	}
 
-	// Read destination port
-	portBuf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBuf); err != nil {
+	// Connect to the destination, racing every resolved address
+	dstAddrPort := net.JoinHostPort(dstAddr, strconv.Itoa(int(dstPort)))
+
+	user := s.connectionUser(conn)
+	egress := l.egressFor(user)
+	session := s.newSession(conn, dstAddr, int(dstPort))
+
+	// Apply the access rules before any packet leaves for the destination
+	if err := s.checkDestination(user, dstAddr, dstIPs, int(dstPort)); err != nil {
+		s.sendReply(conn, CONNECTION_NOT_ALLOWED, nil)
+		s.rejectSession(session, CONNECTION_NOT_ALLOWED)
 		return err
 	}
-	dstPort := binary.BigEndian.Uint16(portBuf)
-
-	// Connect to the destination
-	dstAddrPort := fmt.Sprintf("%s:%d", dstAddr, dstPort)
-	// s.Logger.Info("Connecting to destination", "address", dstAddrPort)
 
-	dstConn, err := net.DialTimeout("tcp", dstAddrPort, 10*time.Second)
+	dstConn, err := rt.Dialer.Dial(context.Background(), dstAddr, dstIPs, int(dstPort), egress)
 	if err != nil {
 		s.Logger.Error("Failed to connect to destination", "address", dstAddrPort, "error", err)
 
 		// Send appropriate error response
-		var replyCode byte
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			replyCode = TTL_EXPIRED
-		} else if opErr, ok := err.(*net.OpError); ok {
-			if opErr.Err.Error() == "connection refused" {
-				replyCode = CONNECTION_REFUSED
-			} else if opErr.Err.Error() == "network is unreachable" {
-				replyCode = NETWORK_UNREACHABLE
-			} else {
-				replyCode = HOST_UNREACHABLE
-			}
-		} else {
-			replyCode = GENERAL_FAILURE
-		}
-
+		replyCode := replyCodeForDialError(err)
 		s.sendReply(conn, replyCode, nil)
+		s.rejectSession(session, replyCode)
 		return err
 	}
 	defer dstConn.Close()
 
-	// Send success reply
+	// The address that won the race is the one actually in use
+	session.ResolvedIP = connectedIP(rt, dstConn)
+
+	// Send success reply with the bound address of the connected socket
 	localAddr := dstConn.LocalAddr().(*net.TCPAddr)
 	s.sendReply(conn, SUCCEEDED, localAddr)
 
-	// Start proxying data
-	// s.Logger.Info("Connection established", "source", conn.RemoteAddr(), "destination", dstAddrPort)
-	s.proxyData(conn, dstConn)
+	// Start proxying data, the access log records the tunnel when it closes
+	s.proxyData(conn, dstConn, session)
 
 	return nil
 }
 
+// replyFunc writes a protocol-specific reply carrying a SOCKS5 reply code
+type replyFunc func(replyCode byte, bindAddr *net.TCPAddr) error
+
 // sendReply sends a reply to the client
 func (s *ProxyServer) sendReply(conn net.Conn, replyCode byte, bindAddr *net.TCPAddr) error {
 	// Default bind address and port (used for errors)
@@ -483,126 +813,284 @@ func (s *ProxyServer) sendReply(conn net.Conn, replyCode byte, bindAddr *net.TCP
 	response = append(response, portBytes...)
 
 	// Send response
+	s.metrics.reply(PROTOCOL_SOCKS5, replyCode)
 	_, err := conn.Write(response)
 	return err
 }
 
-// proxyData handles bidirectional data transfer with rate limiting (hiện đã vô hiệu hóa giới hạn băng thông)
-func (s *ProxyServer) proxyData(client, target net.Conn) {
-	// Create rate limiters for both directions (hiện đã đặt giá trị rất cao để vô hiệu hóa giới hạn)
-	clientLimiter := rate.NewLimiter(rate.Limit(RATE_LIMIT), BURST_LIMIT)
-	targetLimiter := rate.NewLimiter(rate.Limit(RATE_LIMIT), BURST_LIMIT)
+// proxyData handles bidirectional data transfer with rate limiting (hiện đã vô hiệu hóa giới hạn băng thông).
+// The bytes relayed and the side that ended the tunnel are recorded in session.
+func (s *ProxyServer) proxyData(client, target net.Conn, session *Session) {
+	rt := s.runtime()
 
-	// Lấy thông tin kết nối của client để cập nhật số lượng kết nối khi đóng
+	// The live session shows the tunnel's progress while it runs
+	live := sessionOf(client)
+	live.setState(SESSION_STATE_ACTIVE)
+	user := live.User()
 	clientAddr := client.RemoteAddr().String()
-	s.connMutex.RLock()
-	username, userExists := s.connections[clientAddr]
-	s.connMutex.RUnlock()
-
-	// Hàm giảm số lượng kết nối khi kết nối bị đóng
-	decreaseConnectionCount := func() {
-		if userExists {
-			s.connMutex.Lock()
-			// Kiểm tra lại vì có thể đã bị xóa bởi goroutine khác
-			if _, exists := s.connections[clientAddr]; exists {
-				// Giảm số lượng kết nối của user
-				s.userConnections[username]--
-				// s.Logger.Info("Connection closed in proxyData, decreasing count", "username", username, "connections", s.userConnections[username])
-				if s.userConnections[username] <= 0 {
-					delete(s.userConnections, username)
-				}
-				delete(s.connections, clientAddr)
-			}
-			s.connMutex.Unlock()
-		}
+	bytesUp, bytesDown := s.metrics.traffic(user)
+
+	// Create rate limiters for both directions (hiện đã đặt giá trị rất cao để vô hiệu hóa giới hạn)
+	// Session limits are fixed when it starts, a reload only affects new ones
+	upload, download := s.sessionBandwidth(rt, user)
+	defer s.bandwidth.release(user)
+
+	// Traffic in both directions counts against the user's quota
+	s.quota.acquire(user)
+	defer s.quota.release(user)
+
+	// The direction that finishes first tells why the session ended
+	var closeOnce sync.Once
+	closed := func(reason string) {
+		closeOnce.Do(func() { session.CloseReason = reason })
 	}
 
+	// Sessions are cut once they reach the user's or the server's lifetime
+	if lifetime := sessionLifetime(rt, user); lifetime > 0 {
+		timer := time.AfterFunc(time.Until(session.StartedAt.Add(lifetime)), func() {
+			closed(SESSION_CLOSE_LIFETIME)
+			client.Close()
+			target.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// Each direction waits idleTimeout for data, but the tunnel is only idle
+	// once the other direction has been quiet for as long
+	idleTimeout := rt.Config.Proxy.IdleTimeout
+	var lastUp, lastDown atomic.Int64 // Unix nanoseconds of the last data relayed
+	lastUp.Store(time.Now().UnixNano())
+	lastDown.Store(time.Now().UnixNano())
+
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	// Client -> Target
 	go func() {
 		defer wg.Done()
-		defer decreaseConnectionCount() // Đảm bảo giảm số lượng kết nối khi goroutine kết thúc
-		buf := make([]byte, 4096)
-		transferred := int64(0)
+		buf := make([]byte, PROXY_BUFFER_SIZE)
+		clean := false
+		reason := SESSION_CLOSE_ERROR
 
 		for {
+			client.SetReadDeadline(idleDeadline(idleTimeout))
 			n, err := client.Read(buf)
 			if n > 0 {
-				// Apply rate limiting (hiện đã vô hiệu hóa)
+				// Apply the session, user and server-wide rate limits
 				// Giữ lại code rate limiting nhưng đã đặt giá trị RATE_LIMIT và BURST_LIMIT rất cao
-				if err := clientLimiter.WaitN(context.Background(), n); err != nil {
+				if err := waitBandwidth(upload, n); err != nil {
 					s.Logger.Error("Rate limit error", "direction", "client->target", "error", err)
 					break
 				}
 
+				if !s.quota.consume(user, n) {
+					s.Logger.Warn("Traffic quota exhausted, closing session", "username", user.Username, "client", clientAddr)
+					reason = SESSION_CLOSE_QUOTA
+					break
+				}
+
 				// Write to target
+				target.SetWriteDeadline(idleDeadline(idleTimeout))
 				if _, err := target.Write(buf[:n]); err != nil {
-					s.Logger.Error("Write error", "direction", "client->target", "error", err)
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						reason = SESSION_CLOSE_IDLE
+					} else {
+						s.Logger.Error("Write error", "direction", "client->target", "error", err)
+					}
 					break
 				}
 
-				transferred += int64(n)
+				lastUp.Store(time.Now().UnixNano())
+				session.BytesUp += int64(n)
+				live.addTraffic(int64(n), 0)
+				bytesUp.Add(float64(n))
 			}
 
 			if err != nil {
-				if err != io.EOF {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					if !idleSince(&lastDown, idleTimeout) {
+						continue
+					}
+					reason = SESSION_CLOSE_IDLE
+					break
+				}
+				// The other direction closing the session is not an error
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 					s.Logger.Error("Read error", "direction", "client->target", "error", err)
 				}
+				if clean = err == io.EOF; clean {
+					reason = SESSION_CLOSE_CLIENT
+				}
 				break
 			}
 		}
 
-		// s.Logger.Info("Connection closed", "direction", "client->target", "bytes", transferred)
+		closed(reason)
+
+		// Pass a clean EOF on to the other side, tear the session down on
+		// any error (including a forced close during shutdown)
+		if clean {
+			closeWrite(target)
+		} else {
+			client.Close()
+			target.Close()
+		}
 	}()
 
 	// Target -> Client
 	go func() {
 		defer wg.Done()
-		defer decreaseConnectionCount() // Đảm bảo giảm số lượng kết nối khi goroutine kết thúc
-		buf := make([]byte, 4096)
-		transferred := int64(0)
+		buf := make([]byte, PROXY_BUFFER_SIZE)
+		clean := false
+		reason := SESSION_CLOSE_ERROR
 
 		for {
+			target.SetReadDeadline(idleDeadline(idleTimeout))
 			n, err := target.Read(buf)
 			if n > 0 {
-				// Apply rate limiting (hiện đã vô hiệu hóa)
+				// Apply the session, user and server-wide rate limits
 				// Giữ lại code rate limiting nhưng đã đặt giá trị RATE_LIMIT và BURST_LIMIT rất cao
-				if err := targetLimiter.WaitN(context.Background(), n); err != nil {
+				if err := waitBandwidth(download, n); err != nil {
 					s.Logger.Error("Rate limit error", "direction", "target->client", "error", err)
 					break
 				}
 
+				if !s.quota.consume(user, n) {
+					s.Logger.Warn("Traffic quota exhausted, closing session", "username", user.Username, "client", clientAddr)
+					reason = SESSION_CLOSE_QUOTA
+					break
+				}
+
 				// Write to client
+				client.SetWriteDeadline(idleDeadline(idleTimeout))
 				if _, err := client.Write(buf[:n]); err != nil {
-					s.Logger.Error("Write error", "direction", "target->client", "error", err)
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						reason = SESSION_CLOSE_IDLE
+					} else {
+						s.Logger.Error("Write error", "direction", "target->client", "error", err)
+					}
 					break
 				}
 
-				transferred += int64(n)
+				lastDown.Store(time.Now().UnixNano())
+				session.BytesDown += int64(n)
+				live.addTraffic(0, int64(n))
+				bytesDown.Add(float64(n))
 			}
 
 			if err != nil {
-				if err != io.EOF {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					if !idleSince(&lastUp, idleTimeout) {
+						continue
+					}
+					reason = SESSION_CLOSE_IDLE
+					break
+				}
+				// The other direction closing the session is not an error
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 					s.Logger.Error("Read error", "direction", "target->client", "error", err)
 				}
+				if clean = err == io.EOF; clean {
+					reason = SESSION_CLOSE_TARGET
+				}
 				break
 			}
 		}
 
-		// s.Logger.Info("Connection closed", "direction", "target->client", "bytes", transferred)
+		closed(reason)
+
+		// Pass a clean EOF on to the other side, tear the session down on
+		// any error (including a forced close during shutdown)
+		if clean {
+			closeWrite(client)
+		} else {
+			client.Close()
+			target.Close()
+		}
 	}()
 
 	wg.Wait()
+
+	session.ReplyCode = SUCCEEDED
+	session.EndedAt = time.Now()
+	s.finishSession(session)
+}
+
+// sessionLifetime returns the longest a session of user may last: the user's
+// own limit if set, else proxy.maxSessionDuration. 0 means no limit.
+func sessionLifetime(rt *runtimeConfig, user *User) time.Duration {
+	if user != nil && user.MaxSession > 0 {
+		return user.MaxSession
+	}
+	return rt.Config.Proxy.MaxSessionDuration
+}
+
+// idleDeadline returns the deadline of the next read or write of a tunnel,
+// or the zero time for none when idleTimeout is 0
+func idleDeadline(idleTimeout time.Duration) time.Time {
+	if idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(idleTimeout)
+}
+
+// idleSince reports whether the direction whose last transfer is stored in
+// last has been quiet for at least idleTimeout
+func idleSince(last *atomic.Int64, idleTimeout time.Duration) bool {
+	return time.Since(time.Unix(0, last.Load())) >= idleTimeout
+}
+
+// closeWrite signals EOF to the peer of conn while keeping the read side
+// open, or closes conn if it cannot be half-closed
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
 }
 
 func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(EXIT_OK)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_FAILURE)
+	}
+
+	// Stop accepting on SIGTERM (systemd stop/restart) or Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	// Create and start the proxy server
-	server := NewProxyServer(":1080")
-	err := server.Start()
+	server := NewProxyServer(cfg)
+
+	// Re-read the configuration on SIGHUP
+	go server.watchReload(ctx, func() (*Config, error) {
+		return LoadConfig(os.Args[1:])
+	})
+
+	err = server.Start(ctx)
 	if err != nil {
 		fmt.Printf("Error starting server: %v\n", err)
-		os.Exit(1)
+		server.DB.Close()
+		os.Exit(EXIT_FAILURE)
+	}
+
+	// A second signal during the drain terminates immediately
+	stop()
+
+	drainTimeout := server.runtime().Config.Proxy.DrainTimeout
+	server.Logger.Info("Shutting down, draining connections",
+		"connections", server.ActiveConnections(), "timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Logger.Error("Shutdown incomplete", "error", err)
+		os.Exit(EXIT_DRAIN_TIMEOUT)
 	}
+	server.Logger.Info("Shutdown complete")
 }
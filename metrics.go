@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// Path of the Prometheus endpoint on the metrics listener
+	METRICS_PATH = "/metrics"
+
+	// Deadline for a scraper or admin client to send its request headers, and
+	// how long a request in progress gets to finish on shutdown
+	METRICS_READ_TIMEOUT     = 10 * time.Second
+	METRICS_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+	// Why a connection or request was turned away, the reason label of
+	// proxy_connections_rejected_total
+	REJECT_HANDSHAKE       = "handshake"       // Broken PROXY header, TLS or protocol negotiation
+	REJECT_AUTH            = "auth"            // Wrong credentials or unknown client certificate
+	REJECT_MAX_CONNECTIONS = "max_connections" // The user's maxConnection limit was reached
+	REJECT_QUOTA           = "quota"           // The user's traffic quota is used up
+	REJECT_ACL             = "acl"             // The destination is denied by the access rules
+	REJECT_DIAL            = "dial"            // The destination could not be resolved or reached
+	REJECT_BANNED          = "banned"          // The address or username is banned after repeated failed logins
+)
+
+// latencyBuckets are the histogram buckets of dial, DNS and database
+// latencies in seconds, from a LAN round trip up to the default dial timeout
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// proxyMetrics holds the Prometheus metrics updated by the handlers. Gauges
+// that mirror server state, like the listener counters and the sessions per
+// user, are read when scraped by serverCollector instead.
+type proxyMetrics struct {
+	registry *prometheus.Registry
+
+	rejected          *prometheus.CounterVec   // By reason
+	bytes             *prometheus.CounterVec   // By user and direction
+	replies           *prometheus.CounterVec   // SOCKS replies sent, by protocol and code
+	dialDuration      *prometheus.HistogramVec // By result
+	dnsDuration       *prometheus.HistogramVec // Upstream lookups, cache hits excluded, by result
+	authQueryDuration *prometheus.HistogramVec // User table lookups, by result
+}
+
+// newProxyMetrics creates the metrics and a registry holding them along with
+// the Go runtime and process metrics
+func newProxyMetrics() *proxyMetrics {
+	m := &proxyMetrics{
+		registry: prometheus.NewRegistry(),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_connections_rejected_total",
+			Help: "Connections and requests turned away, by reason.",
+		}, []string{"reason"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_transferred_bytes_total",
+			Help: "Bytes relayed, by user and direction. The user is empty for anonymous clients.",
+		}, []string{"user", "direction"}),
+		replies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_socks_replies_total",
+			Help: "SOCKS replies sent to clients, by protocol and reply code.",
+		}, []string{"protocol", "code"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_dial_duration_seconds",
+			Help:    "Time taken to connect to a destination, across every attempt.",
+			Buckets: latencyBuckets,
+		}, []string{"result"}),
+		dnsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_dns_lookup_duration_seconds",
+			Help:    "Time taken by DNS lookups not answered from the cache.",
+			Buckets: latencyBuckets,
+		}, []string{"result"}),
+		authQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_auth_query_duration_seconds",
+			Help:    "Time taken to look up a user in the database during authentication.",
+			Buckets: latencyBuckets,
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		m.rejected, m.bytes, m.replies, m.dialDuration, m.dnsDuration, m.authQueryDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// resultLabel is the result label of an operation that returned err
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// reject counts a connection or request turned away for reason
+func (m *proxyMetrics) reject(reason string) {
+	m.rejected.WithLabelValues(reason).Inc()
+}
+
+// isAuthError reports whether err is a refused login, which authenticate
+// and registerConnection have already counted
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrMaxConnections) || errors.Is(err, ErrQuotaExceeded)
+}
+
+// traffic returns the upload and download byte counters of a user, or of
+// anonymous clients for a nil user
+func (m *proxyMetrics) traffic(user *User) (up, down prometheus.Counter) {
+	var username string
+	if user != nil {
+		username = user.Username
+	}
+	return m.bytes.WithLabelValues(username, "up"), m.bytes.WithLabelValues(username, "down")
+}
+
+// reply counts a SOCKS reply sent to a client
+func (m *proxyMetrics) reply(protocol string, code byte) {
+	m.replies.WithLabelValues(protocol, strconv.Itoa(int(code))).Inc()
+}
+
+// observeDial records how long a dial took, it is the Dialer's OnDial hook
+func (m *proxyMetrics) observeDial(elapsed time.Duration, err error) {
+	m.dialDuration.WithLabelValues(resultLabel(err)).Observe(elapsed.Seconds())
+}
+
+// observeLookup records how long a DNS lookup took, it is the
+// CachingResolver's OnLookup hook
+func (m *proxyMetrics) observeLookup(elapsed time.Duration, err error) {
+	m.dnsDuration.WithLabelValues(resultLabel(err)).Observe(elapsed.Seconds())
+}
+
+// observeAuthQuery records how long a user lookup took
+func (m *proxyMetrics) observeAuthQuery(elapsed time.Duration, err error) {
+	m.authQueryDuration.WithLabelValues(resultLabel(err)).Observe(elapsed.Seconds())
+}
+
+// serverCollector exports the counters the server already keeps, read at
+// scrape time: listener counters, authenticated sessions per user and the
+// DNS cache statistics
+type serverCollector struct {
+	server *ProxyServer
+}
+
+var (
+	acceptedDesc = prometheus.NewDesc("proxy_connections_accepted_total",
+		"Connections accepted, by listener.", []string{"listener", "network"}, nil)
+	acceptErrorsDesc = prometheus.NewDesc("proxy_accept_errors_total",
+		"Failed accept calls, by listener.", []string{"listener", "network"}, nil)
+	activeDesc = prometheus.NewDesc("proxy_connections_active",
+		"Connections currently open, by listener.", []string{"listener", "network"}, nil)
+	userSessionsDesc = prometheus.NewDesc("proxy_user_sessions_active",
+		"Authenticated sessions currently open, by user.", []string{"user"}, nil)
+	dnsCacheLookupsDesc = prometheus.NewDesc("proxy_dns_cache_lookups_total",
+		"DNS cache lookups, by result: hit, negative_hit or miss.", []string{"result"}, nil)
+	dnsCacheEntriesDesc = prometheus.NewDesc("proxy_dns_cache_entries",
+		"Answers currently held in the DNS cache.", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- acceptedDesc
+	ch <- acceptErrorsDesc
+	ch <- activeDesc
+	ch <- userSessionsDesc
+	ch <- dnsCacheLookupsDesc
+	ch <- dnsCacheEntriesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.server.ListenerStats() {
+		ch <- prometheus.MustNewConstMetric(acceptedDesc, prometheus.CounterValue,
+			float64(stats.Accepted), stats.Name, stats.Network)
+		ch <- prometheus.MustNewConstMetric(acceptErrorsDesc, prometheus.CounterValue,
+			float64(stats.AcceptErrors), stats.Name, stats.Network)
+		ch <- prometheus.MustNewConstMetric(activeDesc, prometheus.GaugeValue,
+			float64(stats.Active), stats.Name, stats.Network)
+	}
+
+	for username, sessions := range c.server.registry.Users() {
+		ch <- prometheus.MustNewConstMetric(userSessionsDesc, prometheus.GaugeValue,
+			float64(sessions), username)
+	}
+
+	if resolver, ok := c.server.runtime().Resolver.(*CachingResolver); ok {
+		stats := resolver.Stats()
+		ch <- prometheus.MustNewConstMetric(dnsCacheLookupsDesc, prometheus.CounterValue, float64(stats.Hits), "hit")
+		ch <- prometheus.MustNewConstMetric(dnsCacheLookupsDesc, prometheus.CounterValue, float64(stats.NegativeHits), "negative_hit")
+		ch <- prometheus.MustNewConstMetric(dnsCacheLookupsDesc, prometheus.CounterValue, float64(stats.Misses), "miss")
+		ch <- prometheus.MustNewConstMetric(dnsCacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	}
+}
+
+// serveMetrics binds the metrics listener and serves METRICS_PATH on it
+// until ctx is cancelled
+func (s *ProxyServer) serveMetrics(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	return s.serveHTTP(ctx, "metrics", address, mux)
+}
+
+// serveHTTP binds an internal HTTP listener, like the metrics or admin one,
+// and serves handler on it until ctx is cancelled
+func (s *ProxyServer) serveHTTP(ctx context.Context, name, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("%s listener: %v", name, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: METRICS_READ_TIMEOUT,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Error("HTTP listener failed", "listener", name, "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), METRICS_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	s.Logger.Info("Serving HTTP", "listener", name, "address", listener.Addr().String())
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Deadline for a load balancer to send the PROXY protocol header
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+	// Longest v1 header including CRLF, per the specification
+	PROXY_V1_MAX_LENGTH = 107
+
+	// v2 command and address family values
+	PROXY_V2_LOCAL = 0x0
+	PROXY_V2_PROXY = 0x1
+	PROXY_V2_TCP4  = 0x11
+	PROXY_V2_TCP6  = 0x21
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrProxyHeaderMissing = errors.New("missing PROXY protocol header")
+
+// proxiedConn is a connection received through a load balancer. RemoteAddr
+// returns the client address from the PROXY header, so connection
+// bookkeeping, logging and the UDP source check all see the real client.
+// LocalAddr stays the proxy's own address, which BIND and UDP ASSOCIATE
+// bind to.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader // Holds any client data read along with the header
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite half-closes the socket so proxyData can propagate EOF
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// parseNetworks parses a list of CIDRs or single IPs, like the addresses
+// allowed to send PROXY headers
+func parseNetworks(sources []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", source)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", source, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustsProxyHeader reports whether a PROXY header is expected from the peer
+// of conn
+func (l *listenerSettings) trustsProxyHeader(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.proxyProtocol {
+		if network.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from a trusted load
+// balancer and returns the connection with the client address it carries.
+// Health checks (v2 LOCAL, v1 UNKNOWN) keep the balancer's address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReaderSize(conn, PROXY_BUFFER_SIZE)
+	// Even the shortest v1 header is longer than the v2 signature
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(signature, proxyV2Signature):
+		remote, err = readProxyHeaderV2(reader)
+	case string(signature[:6]) == "PROXY ":
+		remote, err = readProxyHeaderV1(reader)
+	default:
+		return nil, ErrProxyHeaderMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyHeaderV1 parses the text header:
+//
+//	PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n
+//	PROXY UNKNOWN ...\r\n
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < PROXY_V1_MAX_LENGTH {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses the binary header: the signature, a version and
+// command byte, the address family, the length of the rest, then the
+// addresses and optional TLVs, which are skipped.
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0F
+	family := header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %v", err)
+	}
+
+	switch command {
+	case PROXY_V2_LOCAL:
+		return nil, nil
+	case PROXY_V2_PROXY:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case PROXY_V2_TCP4:
+		if len(body) < 12 {
+			return nil, errors.New("PROXY v2 header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case PROXY_V2_TCP6:
+		if len(body) < 36 {
+			return nil, errors.New("PROXY v2 header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// UDP and unix sources are not meaningful for a TCP proxy
+		return nil, nil
+	}
+}
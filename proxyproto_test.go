@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a v2 header with the given command, family and body.
+// length overrides the body length field when not negative.
+func proxyV2Header(command, family byte, body []byte, length int) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	if length < 0 {
+		length = len(body)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	return string(append(header, body...))
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string // Client address, empty for none
+		err    bool
+	}{
+		{name: "tcp4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 51000 1080\r\n", want: "192.0.2.1:51000"},
+		{name: "tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 51000 1080\r\n", want: "[2001:db8::1]:51000"},
+		{name: "unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "unknown with addresses", header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 51000 1080\r\n"},
+		{name: "tcp4 with ipv6 address", header: "PROXY TCP4 2001:db8::1 198.51.100.1 51000 1080\r\n", err: true},
+		{name: "tcp6 with ipv4 address", header: "PROXY TCP6 192.0.2.1 2001:db8::2 51000 1080\r\n", err: true},
+		{name: "invalid address", header: "PROXY TCP4 192.0.2 198.51.100.1 51000 1080\r\n", err: true},
+		{name: "invalid port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 70000 1080\r\n", err: true},
+		{name: "missing fields", header: "PROXY TCP4 192.0.2.1 198.51.100.1 51000\r\n", err: true},
+		{name: "unsupported protocol", header: "PROXY UDP4 192.0.2.1 198.51.100.1 51000 1080\r\n", err: true},
+		{name: "no crlf", header: "PROXY TCP4 192.0.2.1 198.51.100.1 51000 1080\n", err: true},
+		{name: "truncated", header: "PROXY TCP4 192.0.2.1", err: true},
+		{name: "too long", header: "PROXY TCP4 " + strings.Repeat("1", PROXY_V1_MAX_LENGTH) + "\r\n", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeaderV1(bufio.NewReader(strings.NewReader(tt.header)))
+			checkProxyAddr(t, addr, err, tt.want, tt.err)
+		})
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xC7, 0x38, 0x04, 0x38}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xC7, 0x38, 0x04, 0x38)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{name: "tcp4", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP4, tcp4, -1), want: "192.0.2.1:51000"},
+		{name: "tcp6", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP6, tcp6, -1), want: "[2001:db8::1]:51000"},
+		{name: "tcp4 with tlvs", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP4, append(tcp4, 0x04, 0x00, 0x01, 0xFF), -1), want: "192.0.2.1:51000"},
+		{name: "local", header: proxyV2Header(PROXY_V2_LOCAL, 0x00, nil, -1)},
+		{name: "local with addresses", header: proxyV2Header(PROXY_V2_LOCAL, PROXY_V2_TCP4, tcp4, -1)},
+		{name: "unspecified family", header: proxyV2Header(PROXY_V2_PROXY, 0x00, nil, -1)},
+		{name: "udp4", header: proxyV2Header(PROXY_V2_PROXY, 0x12, tcp4, -1)},
+		{name: "tcp4 body too short", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP4, tcp4[:8], -1), err: true},
+		{name: "tcp6 with ipv4 body", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP6, tcp4, -1), err: true},
+		{name: "truncated body", header: proxyV2Header(PROXY_V2_PROXY, PROXY_V2_TCP4, tcp4[:6], len(tcp4)), err: true},
+		{name: "truncated local body", header: proxyV2Header(PROXY_V2_LOCAL, 0x00, nil, 4), err: true},
+		{name: "truncated header", header: string(proxyV2Signature) + "\x21", err: true},
+		{name: "unsupported command", header: proxyV2Header(0x2, PROXY_V2_TCP4, tcp4, -1), err: true},
+		{name: "unsupported version", header: string(proxyV2Signature) + "\x11\x11\x00\x0C" + string(tcp4), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeaderV2(bufio.NewReader(strings.NewReader(tt.header)))
+			checkProxyAddr(t, addr, err, tt.want, tt.err)
+		})
+	}
+}
+
+// checkProxyAddr compares the result of a header parser with the expected
+// client address or error
+func checkProxyAddr(t *testing.T, addr net.Addr, err error, want string, wantErr bool) {
+	t.Helper()
+	if wantErr {
+		if err == nil {
+			t.Fatalf("got address %v, want an error", addr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	switch {
+	case want == "" && addr != nil:
+		t.Fatalf("got address %v, want none", addr)
+	case want != "" && (addr == nil || addr.String() != want):
+		t.Fatalf("got address %v, want %s", addr, want)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Reset periods of the quotaPeriod column
+	QUOTA_DAILY   = "daily"
+	QUOTA_MONTHLY = "monthly"
+	QUOTA_NEVER   = "never"
+
+	// How often used bytes are written to the database and quota changes
+	// made there are read back
+	QUOTA_FLUSH_INTERVAL = 10 * time.Second
+)
+
+var ErrQuotaExceeded = errors.New("traffic quota exhausted")
+
+// quotaPeriodStart returns the start of the reset period containing now, in
+// UTC so that every server agrees on it whatever its time zone. It is zero
+// for quotas that never reset.
+func quotaPeriodStart(period string, now time.Time) time.Time {
+	year, month, day := now.UTC().Date()
+	switch period {
+	case QUOTA_DAILY:
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	case QUOTA_MONTHLY:
+		return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}
+	}
+}
+
+// userQuota is the traffic of a user as seen by this server. Bytes used are
+// stored (the database value) plus pending (counted since the last flush).
+type userQuota struct {
+	allowed     int64 // 0 for unlimited
+	stored      int64
+	pending     int64
+	period      string
+	periodStart time.Time // Start of the period the counters belong to
+	reset       bool      // The period rolled over and the database is not updated yet
+	sessions    int
+}
+
+// exhausted reports whether the user has no bytes left
+func (q *userQuota) exhausted() bool {
+	return q.allowed > 0 && q.stored+q.pending >= q.allowed
+}
+
+// rollover clears the counters when now is past the current period
+func (q *userQuota) rollover(now time.Time) {
+	start := quotaPeriodStart(q.period, now)
+	if start.After(q.periodStart) {
+		q.stored = 0
+		q.pending = 0
+		q.periodStart = start
+		q.reset = true
+	}
+}
+
+// quotaRegistry counts the traffic of users with live sessions and persists
+// it in batches
+type quotaRegistry struct {
+	mutex sync.Mutex
+	users map[string]*userQuota
+}
+
+func newQuotaRegistry() *quotaRegistry {
+	return &quotaRegistry{users: make(map[string]*userQuota)}
+}
+
+// entry returns the counters of a user, creating them from the database
+// values on the user. The caller must hold mutex.
+func (r *quotaRegistry) entry(user *User) *userQuota {
+	q, ok := r.users[user.Username]
+	if !ok {
+		q = &userQuota{
+			allowed:     user.BytesAllowed,
+			stored:      user.BytesUsed,
+			period:      user.QuotaPeriod,
+			periodStart: user.QuotaResetAt,
+		}
+		r.users[user.Username] = q
+	}
+	q.rollover(time.Now())
+	return q
+}
+
+// check refuses a new session of a user who has used up their quota. user
+// must have just been read from the database; its limits replace the ones
+// in memory.
+func (r *quotaRegistry) check(user *User) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q := r.entry(user)
+	q.allowed = user.BytesAllowed
+	if q.period != user.QuotaPeriod {
+		q.period = user.QuotaPeriod
+		q.rollover(time.Now())
+	}
+	if q.exhausted() {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// acquire keeps the counters of a user while a session runs. Every acquire
+// must be paired with a release.
+func (r *quotaRegistry) acquire(user *User) {
+	if user == nil {
+		return
+	}
+	r.mutex.Lock()
+	r.entry(user).sessions++
+	r.mutex.Unlock()
+}
+
+// release ends a session started with acquire. The counters are dropped at
+// the next flush once nothing is pending.
+func (r *quotaRegistry) release(user *User) {
+	if user == nil {
+		return
+	}
+	r.mutex.Lock()
+	if q, ok := r.users[user.Username]; ok {
+		q.sessions--
+	}
+	r.mutex.Unlock()
+}
+
+// consume counts n bytes of traffic and reports whether the user is still
+// within quota. Anonymous traffic is not counted.
+func (r *quotaRegistry) consume(user *User, n int) bool {
+	if user == nil {
+		return true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	q := r.entry(user)
+	q.pending += int64(n)
+	return !q.exhausted()
+}
+
+// exhausted reports whether a user with a live session has used up their
+// quota
+func (r *quotaRegistry) exhausted(user *User) bool {
+	if user == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.entry(user).exhausted()
+}
+
+// quotaUpdate is the pending traffic of one user taken by flush
+type quotaUpdate struct {
+	username    string
+	bytes       int64
+	reset       bool
+	periodStart time.Time
+}
+
+// flush writes the pending traffic to the database in one transaction, then
+// reads back the counters and limits of every tracked user so changes made
+// in the database apply to running sessions. On error the traffic stays
+// pending for the next flush.
+func (r *quotaRegistry) flush(db *sql.DB) error {
+	var updates []quotaUpdate
+	r.mutex.Lock()
+	for username, q := range r.users {
+		if q.pending > 0 || q.reset {
+			updates = append(updates, quotaUpdate{username, q.pending, q.reset, q.periodStart})
+			q.pending = 0
+			q.reset = false
+		}
+	}
+	r.mutex.Unlock()
+
+	if err := writeQuotaUpdates(db, updates); err != nil {
+		r.mutex.Lock()
+		for _, u := range updates {
+			if q, ok := r.users[u.username]; ok {
+				q.pending += u.bytes
+				q.reset = q.reset || u.reset
+			}
+		}
+		r.mutex.Unlock()
+		return err
+	}
+
+	r.mutex.Lock()
+	for _, u := range updates {
+		if q, ok := r.users[u.username]; ok {
+			q.stored += u.bytes
+		}
+	}
+	usernames := make([]any, 0, len(r.users))
+	for username, q := range r.users {
+		if q.sessions <= 0 && q.pending == 0 && !q.reset {
+			delete(r.users, username)
+			continue
+		}
+		usernames = append(usernames, username)
+	}
+	r.mutex.Unlock()
+
+	return r.refresh(db, usernames)
+}
+
+// writeQuotaUpdates adds the traffic of each user to bytesUsed, or replaces
+// it when the period rolled over
+func writeQuotaUpdates(db *sql.DB, updates []quotaUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start quota update: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		if u.reset {
+			_, err = tx.Exec("UPDATE user SET bytesUsed = ?, quotaResetAt = ? WHERE username = ?",
+				u.bytes, u.periodStart, u.username)
+		} else {
+			_, err = tx.Exec("UPDATE user SET bytesUsed = bytesUsed + ? WHERE username = ?",
+				u.bytes, u.username)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update quota of %s: %v", u.username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit quota update: %v", err)
+	}
+	return nil
+}
+
+// refresh re-reads the quota columns of the given users
+func (r *quotaRegistry) refresh(db *sql.DB, usernames []any) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	query := "SELECT username, bytesAllowed, bytesUsed, quotaPeriod FROM user WHERE username IN (?" +
+		strings.Repeat(", ?", len(usernames)-1) + ")"
+	rows, err := db.Query(query, usernames...)
+	if err != nil {
+		return fmt.Errorf("failed to query quotas: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username, period string
+		var allowed, used int64
+		if err := rows.Scan(&username, &allowed, &used, &period); err != nil {
+			return fmt.Errorf("failed to read quota: %v", err)
+		}
+
+		r.mutex.Lock()
+		if q, ok := r.users[username]; ok {
+			q.allowed = allowed
+			q.period = period
+			// A rollover not written yet keeps the cleared counter
+			if !q.reset {
+				q.stored = used
+			}
+			q.rollover(time.Now())
+		}
+		r.mutex.Unlock()
+	}
+	return rows.Err()
+}
+
+// watchQuota persists traffic counters until ctx is cancelled. Shutdown
+// writes the last batch.
+func (s *ProxyServer) watchQuota(ctx context.Context) {
+	ticker := time.NewTicker(QUOTA_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.quota.flush(s.DB); err != nil {
+				s.Logger.Error("Failed to save traffic quotas", "error", err)
+			}
+		}
+	}
+}
+
+// quotaWriter counts the bytes written through it against a user's quota
+type quotaWriter struct {
+	w     io.Writer
+	quota *quotaRegistry
+	user  *User
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if !w.quota.consume(w.user, len(b)) {
+		return 0, ErrQuotaExceeded
+	}
+	return w.w.Write(b)
+}
+
+// quotaReader counts the bytes read through it against a user's quota
+type quotaReader struct {
+	io.ReadCloser
+	quota *quotaRegistry
+	user  *User
+}
+
+func (r *quotaReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 && !r.quota.consume(r.user, n) {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// States of a live session
+	SESSION_STATE_HANDSHAKE  = "handshake"  // Negotiating the protocol and credentials
+	SESSION_STATE_CONNECTING = "connecting" // Checking and dialing the destination
+	SESSION_STATE_ACTIVE     = "active"     // Relaying data
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// LiveSession is a client connection tracked from the moment it is handed to
+// handleConnection until the handler returns
+type LiveSession struct {
+	ID        uint64
+	Listener  string
+	Client    string
+	StartedAt time.Time
+
+	conn      net.Conn
+	bytesUp   atomic.Int64 // Client to destination
+	bytesDown atomic.Int64 // Destination to client
+
+	mutex sync.Mutex
+	user  *User // nil until the client authenticates, or for anonymous clients
+	host  string
+	port  int
+	state string
+}
+
+// SessionInfo is a snapshot of a live session
+type SessionInfo struct {
+	ID        uint64    `json:"id"`
+	Username  string    `json:"username"`
+	Listener  string    `json:"listener"`
+	Client    string    `json:"client"`
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"startedAt"`
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+}
+
+// User returns the user the session authenticated as, or nil. It is safe to
+// call on a nil session.
+func (ls *LiveSession) User() *User {
+	if ls == nil {
+		return nil
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.user
+}
+
+// connecting records the destination the client asked for
+func (ls *LiveSession) connecting(host string, port int) {
+	if ls == nil {
+		return
+	}
+	ls.mutex.Lock()
+	ls.host, ls.port, ls.state = host, port, SESSION_STATE_CONNECTING
+	ls.mutex.Unlock()
+}
+
+// setState moves the session to a new state
+func (ls *LiveSession) setState(state string) {
+	if ls == nil {
+		return
+	}
+	ls.mutex.Lock()
+	ls.state = state
+	ls.mutex.Unlock()
+}
+
+// addTraffic adds relayed bytes to the live counters
+func (ls *LiveSession) addTraffic(up, down int64) {
+	if ls == nil {
+		return
+	}
+	ls.bytesUp.Add(up)
+	ls.bytesDown.Add(down)
+}
+
+// Info returns a snapshot of the session
+func (ls *LiveSession) Info() SessionInfo {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	info := SessionInfo{
+		ID:        ls.ID,
+		Listener:  ls.Listener,
+		Client:    ls.Client,
+		Host:      ls.host,
+		Port:      ls.port,
+		State:     ls.state,
+		StartedAt: ls.StartedAt,
+		BytesUp:   ls.bytesUp.Load(),
+		BytesDown: ls.bytesDown.Load(),
+	}
+	if ls.user != nil {
+		info.Username = ls.user.Username
+	}
+	return info
+}
+
+// SessionRegistry holds every live client connection under a unique ID and
+// counts the authenticated ones per user for the maxConnection limit
+type SessionRegistry struct {
+	nextID atomic.Uint64
+
+	mutex    sync.RWMutex
+	sessions map[uint64]*LiveSession
+	users    map[string]int // Authenticated sessions per username
+}
+
+// NewSessionRegistry creates an empty registry
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[uint64]*LiveSession),
+		users:    make(map[string]int),
+	}
+}
+
+// Register starts tracking a client connection accepted on a listener
+func (r *SessionRegistry) Register(conn net.Conn, listener string) *LiveSession {
+	session := &LiveSession{
+		ID:        r.nextID.Add(1),
+		Listener:  listener,
+		Client:    conn.RemoteAddr().String(),
+		StartedAt: time.Now(),
+		conn:      conn,
+		state:     SESSION_STATE_HANDSHAKE,
+	}
+
+	r.mutex.Lock()
+	r.sessions[session.ID] = session
+	r.mutex.Unlock()
+	return session
+}
+
+// Unregister stops tracking a session and releases its connection slot
+func (r *SessionRegistry) Unregister(session *LiveSession) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.sessions[session.ID]; !ok {
+		return
+	}
+	delete(r.sessions, session.ID)
+
+	if user := session.User(); user != nil {
+		r.users[user.Username]--
+		if r.users[user.Username] <= 0 {
+			delete(r.users, user.Username)
+		}
+	}
+}
+
+// Authenticate assigns a user to a session, taking one of the user's
+// maxConnection slots. It fails with ErrMaxConnections when none are left.
+func (r *SessionRegistry) Authenticate(session *LiveSession, user *User) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.users[user.Username] >= user.MaxConnection {
+		return ErrMaxConnections
+	}
+	if _, ok := r.sessions[session.ID]; !ok {
+		return ErrSessionNotFound
+	}
+
+	session.mutex.Lock()
+	session.user = user
+	session.mutex.Unlock()
+	r.users[user.Username]++
+	return nil
+}
+
+// Count returns the number of authenticated sessions of a user
+func (r *SessionRegistry) Count(username string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.users[username]
+}
+
+// Users returns the number of authenticated sessions of every user with at
+// least one
+func (r *SessionRegistry) Users() map[string]int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return maps.Clone(r.users)
+}
+
+// Len returns the number of live sessions
+func (r *SessionRegistry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.sessions)
+}
+
+// List returns a snapshot of every live session, oldest first
+func (r *SessionRegistry) List() []SessionInfo {
+	return r.list(func(*LiveSession) bool { return true })
+}
+
+// ListUser returns a snapshot of the live sessions of a user, oldest first
+func (r *SessionRegistry) ListUser(username string) []SessionInfo {
+	return r.list(func(session *LiveSession) bool {
+		user := session.User()
+		return user != nil && user.Username == username
+	})
+}
+
+func (r *SessionRegistry) list(match func(*LiveSession) bool) []SessionInfo {
+	r.mutex.RLock()
+	sessions := make([]*LiveSession, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		if match(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	r.mutex.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// Close force-closes the client connection of a session, which ends its
+// tunnel. The session leaves the registry once its handler returns.
+func (r *SessionRegistry) Close(id uint64) error {
+	r.mutex.RLock()
+	session, ok := r.sessions[id]
+	r.mutex.RUnlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return session.conn.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	r := NewSessionRegistry()
+	alice := &User{Username: "alice", MaxConnection: 2}
+	bob := &User{Username: "bob", MaxConnection: 1}
+
+	type client struct {
+		session *LiveSession
+		peer    net.Conn // The client's end of the connection
+	}
+	register := func(user *User) client {
+		t.Helper()
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { conn.Close(); peer.Close() })
+		session := r.Register(conn, "main")
+		if user != nil {
+			if err := r.Authenticate(session, user); err != nil {
+				t.Fatalf("authenticate %s: %v", user.Username, err)
+			}
+		}
+		return client{session: session, peer: peer}
+	}
+	ids := func(infos []SessionInfo) []uint64 {
+		var ids []uint64
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		return ids
+	}
+
+	anonymous := register(nil)
+	a1 := register(alice)
+	a2 := register(alice)
+	b1 := register(bob)
+
+	// Limits are enforced per user
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	refused := r.Register(conn, "main")
+	if err := r.Authenticate(refused, bob); !errors.Is(err, ErrMaxConnections) {
+		t.Fatalf("third bob session: got %v, want ErrMaxConnections", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  []uint64
+		want []uint64
+	}{
+		{"list", ids(r.List()), []uint64{anonymous.session.ID, a1.session.ID, a2.session.ID, b1.session.ID, refused.ID}},
+		{"list alice", ids(r.ListUser("alice")), []uint64{a1.session.ID, a2.session.ID}},
+		{"list bob", ids(r.ListUser("bob")), []uint64{b1.session.ID}},
+		{"list unknown", ids(r.ListUser("carol")), nil},
+	} {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if info := a1.session.Info(); info.Username != "alice" || info.Listener != "main" || info.State != SESSION_STATE_HANDSHAKE {
+		t.Fatalf("unexpected snapshot %+v", info)
+	}
+	if r.Len() != 5 || r.Count("alice") != 2 {
+		t.Fatalf("got %d sessions and %d for alice, want 5 and 2", r.Len(), r.Count("alice"))
+	}
+
+	// Closing a session closes its client connection but keeps it
+	// registered until its handler unregisters it
+	if err := r.Close(a1.session.ID); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := a1.peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read after close: got %v, want EOF", err)
+	}
+	if err := r.Close(1000); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("close unknown: got %v, want ErrSessionNotFound", err)
+	}
+	if r.Len() != 5 {
+		t.Fatalf("got %d sessions after close, want 5", r.Len())
+	}
+
+	// Unregistering releases the user's slot, once
+	r.Unregister(a1.session)
+	r.Unregister(a1.session)
+	if r.Len() != 4 || r.Count("alice") != 1 {
+		t.Fatalf("got %d sessions and %d for alice after unregister, want 4 and 1", r.Len(), r.Count("alice"))
+	}
+	if err := r.Authenticate(a1.session, alice); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("authenticate unregistered: got %v, want ErrSessionNotFound", err)
+	}
+	r.Unregister(b1.session)
+	if _, ok := r.Users()["bob"]; ok {
+		t.Fatal("bob still counted after the last session ended")
+	}
+}
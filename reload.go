@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"golang.org/x/time/rate"
+)
+
+// runtimeConfig is the server state derived from the configuration. A reload
+// builds a new one and swaps it in atomically. Handlers load it once when a
+// connection starts, so existing sessions keep the settings they started
+// with while new connections pick up the new ones.
+type runtimeConfig struct {
+	Config        *Config
+	Resolver      Resolver        // Resolves destination host names
+	Dialer        *Dialer         // Outbound dialer used for every destination
+	httpTransport *http.Transport // Upstream connection pool for plain HTTP forwarding
+	RateLimit     rate.Limit      // Bandwidth limit per direction, in bytes per second
+	BurstLimit    int             // Bandwidth burst size, in bytes
+}
+
+// newRuntimeConfig builds the runtime state for a validated config. The
+// previous resolver, and with it the DNS cache, is kept when the DNS settings
+// did not change. Dial and DNS lookup latencies are reported to metrics.
+func newRuntimeConfig(cfg *Config, previous *runtimeConfig, metrics *proxyMetrics) (*runtimeConfig, error) {
+	var resolver Resolver
+	if previous != nil &&
+		slices.Equal(previous.Config.Proxy.DNSUpstreams, cfg.Proxy.DNSUpstreams) &&
+		previous.Config.Proxy.DNSTimeout == cfg.Proxy.DNSTimeout {
+		resolver = previous.Resolver
+	} else {
+		cachingResolver, err := NewResolver(cfg.Proxy.DNSUpstreams, cfg.Proxy.DNSTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create resolver: %v", err)
+		}
+		cachingResolver.OnLookup = metrics.observeLookup
+		resolver = cachingResolver
+	}
+
+	dialer := &Dialer{
+		Resolver:     resolver,
+		Chain:        cfg.chain,
+		Timeout:      cfg.Proxy.DialTimeout,
+		AttemptDelay: DIAL_ATTEMPT_DELAY,
+		OnDial:       metrics.observeDial,
+	}
+	return &runtimeConfig{
+		Config:        cfg,
+		Resolver:      resolver,
+		Dialer:        dialer,
+		httpTransport: newHTTPTransport(dialer, nil),
+		RateLimit:     rate.Limit(cfg.Proxy.RateLimit),
+		BurstLimit:    cfg.Proxy.BurstLimit,
+	}, nil
+}
+
+// httpTransportFor returns the HTTP forwarding transport for an egress pool
+func (rt *runtimeConfig) httpTransportFor(egress *EgressPool) *http.Transport {
+	if egress == nil {
+		return rt.httpTransport
+	}
+	return egress.httpTransport(rt.Dialer)
+}
+
+// runtime returns the current runtime state
+func (s *ProxyServer) runtime() *runtimeConfig {
+	return s.settings.Load()
+}
+
+// Reload applies a new, already validated configuration to new connections.
+// Everything that can fail is prepared first, so on error the server keeps
+// running on its current configuration. Once the configuration is applied,
+// ACL rules and user rates are reloaded from the database; if that fails the
+// previous rules and rates are kept, like the periodic reloads do. Database,
+// metrics and admin listener and access log settings only take effect on
+// restart.
+func (s *ProxyServer) Reload(cfg *Config) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	current := s.runtime()
+	next, err := newRuntimeConfig(cfg, current, s.metrics)
+	if err != nil {
+		return err
+	}
+
+	// Bind new listeners before releasing old ones. Once stopped, Start has
+	// closed every listener and none are opened again.
+	if s.listeners != nil {
+		if err := s.updateListeners(cfg.listeners); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Database != current.Config.Database {
+		s.Logger.Warn("Database settings changed, restart required to apply them")
+	}
+	if cfg.Proxy.MetricsListen != current.Config.Proxy.MetricsListen {
+		s.Logger.Warn("Metrics listener changed, restart required to apply it")
+	}
+	if cfg.Proxy.AdminListen != current.Config.Proxy.AdminListen {
+		s.Logger.Warn("Admin listener changed, restart required to apply it")
+	}
+	if cfg.Proxy.AccessLog != current.Config.Proxy.AccessLog {
+		s.Logger.Warn("Access log settings changed, restart required to apply them")
+	}
+
+	// A database problem is not a configuration error, so the new settings
+	// apply even if the rules or rates cannot be read
+	if err := s.ACL.Load(s.DB); err != nil {
+		s.Logger.Error("Failed to reload ACL rules, keeping previous rules", "error", err)
+	}
+	// Apply rate changes in the user table now instead of at the next poll
+	if err := s.bandwidth.refresh(s.DB); err != nil {
+		s.Logger.Error("Failed to reload bandwidth limits", "error", err)
+	}
+
+	s.settings.Store(next)
+	s.logLevel.Set(cfg.logLevel)
+	s.bandwidth.setGlobal(cfg.Proxy.GlobalRateLimit)
+	s.bruteForce.configure(cfg.Proxy.BruteForce)
+
+	// Sessions still using the old transport keep their active connections
+	current.httpTransport.CloseIdleConnections()
+	return nil
+}
+
+// watchReload reloads the configuration on every SIGHUP until ctx is
+// cancelled. An invalid configuration is logged and ignored.
+func (s *ProxyServer) watchReload(ctx context.Context, load func() (*Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		cfg, err := load()
+		if err == nil {
+			err = s.Reload(cfg)
+		}
+		if err != nil {
+			s.Logger.Error("Configuration reload rejected, keeping current configuration", "error", err)
+			continue
+		}
+		s.Logger.Info("Configuration reloaded", "rules", s.ACL.Len())
+	}
+}
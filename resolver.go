@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Per-query timeout for each upstream attempt
+	DNS_QUERY_TIMEOUT = 5 * time.Second
+
+	// TTLs used when the answer does not carry one (system resolver)
+	DNS_DEFAULT_TTL  = 60 * time.Second
+	DNS_NEGATIVE_TTL = 30 * time.Second
+
+	// Bounds applied to TTLs before caching
+	DNS_MIN_TTL = 5 * time.Second
+	DNS_MAX_TTL = 1 * time.Hour
+
+	// Maximum number of names kept in the cache
+	DNS_CACHE_SIZE = 10000
+
+	// Largest DNS message we accept
+	DNS_MAX_MESSAGE_SIZE = 65535
+)
+
+// Resolver looks up the IP addresses of a host name
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// ttlResolver is implemented by resolvers that know how long an answer may be
+// cached. The TTL of a not-found error is the negative caching TTL.
+type ttlResolver interface {
+	LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// SystemResolver resolves names with the host's resolver
+type SystemResolver struct{}
+
+// LookupIP implements Resolver
+func (SystemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// NewResolver builds the resolver described by a list of upstream URLs.
+// With no upstreams the system resolver is used. The result is always
+// wrapped in a cache.
+func NewResolver(upstreams []string, timeout time.Duration) (*CachingResolver, error) {
+	if len(upstreams) == 0 {
+		return NewCachingResolver(SystemResolver{}), nil
+	}
+
+	dnsResolver := &DNSResolver{Timeout: timeout}
+	for _, raw := range upstreams {
+		upstream, err := ParseUpstream(raw)
+		if err != nil {
+			return nil, err
+		}
+		dnsResolver.Upstreams = append(dnsResolver.Upstreams, upstream)
+	}
+
+	return NewCachingResolver(dnsResolver), nil
+}
+
+// CacheStats is a snapshot of the resolver cache counters
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Evictions    uint64
+	Entries      int
+}
+
+// cacheEntry is a cached positive or negative answer
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// CachingResolver caches the answers of another resolver, honouring the TTLs
+// of positive answers and caching not-found answers for the negative TTL
+type CachingResolver struct {
+	resolver Resolver
+
+	// OnLookup, when set, is called after every lookup that was not answered
+	// from the cache with the time taken and the result
+	OnLookup func(elapsed time.Duration, err error)
+
+	mutex   sync.RWMutex
+	entries map[string]*cacheEntry
+
+	hits         atomic.Uint64
+	negativeHits atomic.Uint64
+	misses       atomic.Uint64
+	evictions    atomic.Uint64
+}
+
+// NewCachingResolver wraps resolver with a TTL-respecting cache
+func NewCachingResolver(resolver Resolver) *CachingResolver {
+	return &CachingResolver{
+		resolver: resolver,
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+// LookupIP implements Resolver
+func (r *CachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+
+	r.mutex.RLock()
+	entry, ok := r.entries[key]
+	r.mutex.RUnlock()
+
+	if ok && now.Before(entry.expires) {
+		if entry.err != nil {
+			r.negativeHits.Add(1)
+			return nil, entry.err
+		}
+		r.hits.Add(1)
+		return entry.ips, nil
+	}
+	r.misses.Add(1)
+
+	ips, ttl, err := r.lookup(ctx, key)
+	if r.OnLookup != nil {
+		r.OnLookup(time.Since(now), err)
+	}
+	if err != nil && !isNotFound(err) {
+		// Timeouts and server failures are not cached
+		return nil, err
+	}
+
+	r.store(key, &cacheEntry{ips: ips, err: err, expires: now.Add(clampTTL(ttl))})
+	return ips, err
+}
+
+// Stats returns a snapshot of the cache counters
+func (r *CachingResolver) Stats() CacheStats {
+	r.mutex.RLock()
+	entries := len(r.entries)
+	r.mutex.RUnlock()
+
+	return CacheStats{
+		Hits:         r.hits.Load(),
+		NegativeHits: r.negativeHits.Load(),
+		Misses:       r.misses.Load(),
+		Evictions:    r.evictions.Load(),
+		Entries:      entries,
+	}
+}
+
+// lookup queries the wrapped resolver and works out how long to cache it
+func (r *CachingResolver) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if tr, ok := r.resolver.(ttlResolver); ok {
+		return tr.LookupIPTTL(ctx, host)
+	}
+
+	ips, err := r.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, DNS_NEGATIVE_TTL, err
+	}
+	return ips, DNS_DEFAULT_TTL, nil
+}
+
+// store adds an entry, making room by dropping expired entries first and an
+// arbitrary one if the cache is still full
+func (r *CachingResolver) store(key string, entry *cacheEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.entries[key]; !exists && len(r.entries) >= DNS_CACHE_SIZE {
+		now := time.Now()
+		for k, e := range r.entries {
+			if now.After(e.expires) {
+				delete(r.entries, k)
+				r.evictions.Add(1)
+			}
+		}
+		for k := range r.entries {
+			if len(r.entries) < DNS_CACHE_SIZE {
+				break
+			}
+			delete(r.entries, k)
+			r.evictions.Add(1)
+		}
+	}
+
+	r.entries[key] = entry
+}
+
+// clampTTL keeps TTLs within DNS_MIN_TTL and DNS_MAX_TTL
+func clampTTL(ttl time.Duration) time.Duration {
+	return min(max(ttl, DNS_MIN_TTL), DNS_MAX_TTL)
+}
+
+// isNotFound reports whether err is an authoritative "no such host" answer
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// DNSResolver resolves names by sending A and AAAA queries to its upstreams,
+// trying them in order until one answers
+type DNSResolver struct {
+	Upstreams []Upstream
+	Timeout   time.Duration // Per-query timeout
+}
+
+// LookupIP implements Resolver
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPTTL implements ttlResolver. A and AAAA are queried in parallel and
+// the smallest TTL of the two answers is returned.
+func (r *DNSResolver) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	// IP literals need no lookup
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, DNS_MAX_TTL, nil
+	}
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	results := make(chan answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := r.query(ctx, host, qtype)
+			results <- answer{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration = DNS_MAX_TTL
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		a := <-results
+		if a.err != nil && !isNotFound(a.err) {
+			firstErr = a.err
+			continue
+		}
+		ips = append(ips, a.ips...)
+		ttl = min(ttl, a.ttl)
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// query sends a single question to each upstream in turn
+func (r *DNSResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	var lastErr error = errors.New("no DNS upstreams configured")
+	for _, upstream := range r.Upstreams {
+		id := uint16(rand.UintN(1 << 16))
+		msg, err := buildDNSQuery(id, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		queryCtx, cancel := context.WithTimeout(ctx, r.Timeout)
+		resp, err := upstream.Exchange(queryCtx, msg)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", upstream, err)
+			continue
+		}
+
+		ips, ttl, err := parseDNSResponse(resp, id, host, qtype)
+		if err != nil && !isNotFound(err) {
+			lastErr = fmt.Errorf("%s: %w", upstream, err)
+			continue
+		}
+		return ips, ttl, err
+	}
+
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, IsTemporary: true}
+}
+
+// buildDNSQuery builds a recursive query for one name and type
+func buildDNSQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// parseDNSResponse extracts the addresses of the requested type and their
+// TTL. NXDOMAIN and empty answers become not-found errors whose TTL comes
+// from the SOA record in the authority section (RFC 2308).
+func parseDNSResponse(msg []byte, id uint16, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id {
+		return nil, 0, errors.New("DNS response ID mismatch")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("DNS server returned %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32 = uint32(DNS_MAX_TTL / time.Second)
+	for {
+		h, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+			ttl = min(ttl, h.TTL)
+		case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+			ttl = min(ttl, h.TTL)
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+
+	// Negative answer: the SOA in the authority section sets the TTL
+	negativeTTL := DNS_NEGATIVE_TTL
+	for {
+		h, err := parser.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if parser.SkipAuthority() != nil {
+				break
+			}
+			continue
+		}
+		soa, err := parser.SOAResource()
+		if err != nil {
+			break
+		}
+		negativeTTL = time.Duration(min(h.TTL, soa.MinTTL)) * time.Second
+		break
+	}
+
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// Upstream exchanges a raw DNS message with a DNS server
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// ParseUpstream parses an upstream URL:
+//
+//	udp://1.1.1.1:53                      plain DNS over UDP (TCP on truncation)
+//	tcp://1.1.1.1:53                      plain DNS over TCP
+//	tls://1.1.1.1:853                     DNS-over-TLS (RFC 7858)
+//	https://cloudflare-dns.com/dns-query  DNS-over-HTTPS (RFC 8484)
+//
+// A bare host:port is treated as udp://.
+func ParseUpstream(raw string) (Upstream, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS upstream %q: %v", raw, err)
+	}
+
+	withPort := func(defaultPort string) string {
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), defaultPort)
+		}
+		return u.Host
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withPort("53")}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withPort("53")}, nil
+	case "tls":
+		return &tcpUpstream{addr: withPort("853"), tlsConfig: &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}}, nil
+	case "https":
+		return &httpsUpstream{url: u.String(), client: &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+			},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS upstream scheme %q", u.Scheme)
+	}
+}
+
+// udpUpstream is a plain DNS server reached over UDP
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) String() string { return "udp://" + u.addr }
+
+// Exchange implements Upstream, retrying over TCP if the answer is truncated
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, DNS_MAX_MESSAGE_SIZE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer our query
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		// TC bit: the answer did not fit, ask again over TCP
+		if buf[2]&0x02 != 0 {
+			return (&tcpUpstream{addr: u.addr}).Exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// tcpUpstream is a DNS server reached over TCP, optionally wrapped in TLS
+type tcpUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+// Exchange implements Upstream using two-byte length-prefixed messages
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if u.tlsConfig != nil {
+		dialer := &tls.Dialer{Config: u.tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", u.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsUpstream is a DNS-over-HTTPS server
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+// Exchange implements Upstream with an RFC 8484 POST request
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, DNS_MAX_MESSAGE_SIZE))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Finished sessions waiting to be written. When the database falls this
+	// far behind, new records are dropped instead of slowing down tunnels.
+	SESSION_QUEUE_SIZE = 10000
+
+	// Rows per INSERT, and the longest a finished session waits for a batch
+	SESSION_BATCH_SIZE     = 200
+	SESSION_FLUSH_INTERVAL = 2 * time.Second
+
+	// Why a session ended, stored in closeReason
+	SESSION_CLOSE_CLIENT   = "client"   // The client closed the connection
+	SESSION_CLOSE_TARGET   = "target"   // The destination closed the connection
+	SESSION_CLOSE_ERROR    = "error"    // A read or write failed, or the server cut the session
+	SESSION_CLOSE_QUOTA    = "quota"    // The user's traffic quota ran out
+	SESSION_CLOSE_IDLE     = "idle"     // No data in either direction for proxy.idleTimeout
+	SESSION_CLOSE_LIFETIME = "lifetime" // The session reached its maximum duration
+	SESSION_CLOSE_REJECTED = "rejected" // No tunnel was set up, see replyCode
+)
+
+// Session is one row of the session table: a tunnel from a client to a
+// destination, or a request that was refused before the tunnel was set up
+type Session struct {
+	Username    string // Empty for anonymous clients
+	ClientAddr  string
+	Host        string // Destination as requested, a hostname or an IP
+	Port        int
+	ResolvedIP  string // Address actually connected to, empty through a proxy chain
+	StartedAt   time.Time
+	EndedAt     time.Time
+	BytesUp     int64 // Client to destination
+	BytesDown   int64 // Destination to client
+	ReplyCode   byte  // SOCKS5 reply code, SOCKS4 and HTTP CONNECT are mapped to it
+	CloseReason string
+}
+
+// newSession starts the record of a request from the client on conn and
+// shows the destination on its live session
+func (s *ProxyServer) newSession(conn net.Conn, host string, port int) *Session {
+	session := &Session{
+		ClientAddr: conn.RemoteAddr().String(),
+		Host:       host,
+		Port:       port,
+		StartedAt:  time.Now(),
+	}
+	live := sessionOf(conn)
+	live.connecting(host, port)
+	if user := live.User(); user != nil {
+		session.Username = user.Username
+	}
+	return session
+}
+
+// rejectSession records a request refused with replyCode before any data
+// was relayed and counts it as refused by the access rules or as a failed
+// dial
+func (s *ProxyServer) rejectSession(session *Session, replyCode byte) {
+	if replyCode == CONNECTION_NOT_ALLOWED {
+		s.metrics.reject(REJECT_ACL)
+	} else {
+		s.metrics.reject(REJECT_DIAL)
+	}
+
+	session.ReplyCode = replyCode
+	session.CloseReason = SESSION_CLOSE_REJECTED
+	session.EndedAt = time.Now()
+	s.finishSession(session)
+}
+
+// finishSession hands a session that has ended to the session table and the
+// access log
+func (s *ProxyServer) finishSession(session *Session) {
+	s.sessionLog.Record(session)
+	s.accessLog.Record(session)
+}
+
+// connectedIP returns the destination address of an outbound connection, or
+// an empty string when it leads to a parent proxy instead
+func connectedIP(rt *runtimeConfig, conn net.Conn) string {
+	if rt.Dialer.UsesChain() {
+		return ""
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// sessionWriter stores finished sessions in the session table from a single
+// goroutine, in multi-row INSERTs. Record never blocks, so tunnels are not
+// slowed down by the database.
+type sessionWriter struct {
+	db     *sql.DB
+	logger *slog.Logger
+	queue  chan *Session
+	stop   chan struct{}
+	done   chan struct{}
+
+	dropped atomic.Int64 // Records lost to a full queue since the last warning
+}
+
+// newSessionWriter starts a writer, Close stops it
+func newSessionWriter(db *sql.DB, logger *slog.Logger) *sessionWriter {
+	w := &sessionWriter{
+		db:     db,
+		logger: logger,
+		queue:  make(chan *Session, SESSION_QUEUE_SIZE),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Record queues a finished session, dropping it if the queue is full
+func (w *sessionWriter) Record(session *Session) {
+	select {
+	case w.queue <- session:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close writes the sessions still queued and stops the writer. Sessions
+// recorded afterwards are not written.
+func (w *sessionWriter) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *sessionWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(SESSION_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]*Session, 0, SESSION_BATCH_SIZE)
+	for {
+		select {
+		case session := <-w.queue:
+			batch = append(batch, session)
+			if len(batch) < SESSION_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+		case <-w.stop:
+			for {
+				select {
+				case session := <-w.queue:
+					batch = append(batch, session)
+					if len(batch) == SESSION_BATCH_SIZE {
+						w.write(batch)
+						batch = batch[:0]
+					}
+				default:
+					w.write(batch)
+					return
+				}
+			}
+		}
+
+		w.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write inserts a batch of sessions. A failed batch is logged and dropped.
+func (w *sessionWriter) write(batch []*Session) {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		w.logger.Warn("Session queue full, records dropped", "sessions", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	rows := make([]string, 0, len(batch))
+	args := make([]any, 0, len(batch)*11)
+	for _, session := range batch {
+		rows = append(rows, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, sql.NullString{String: session.Username, Valid: session.Username != ""},
+			session.ClientAddr, session.Host, session.Port,
+			sql.NullString{String: session.ResolvedIP, Valid: session.ResolvedIP != ""},
+			session.StartedAt, session.EndedAt, session.BytesUp, session.BytesDown,
+			session.ReplyCode, session.CloseReason)
+	}
+
+	query := "INSERT INTO session (username, clientAddr, host, port, resolvedIP, startedAt, endedAt, " +
+		"bytesUp, bytesDown, replyCode, closeReason) VALUES " + strings.Join(rows, ", ")
+	if _, err := w.db.Exec(query, args...); err != nil {
+		w.logger.Error("Failed to save sessions", "sessions", len(batch), "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// Default time in-flight sessions get to finish after SIGTERM
+	SHUTDOWN_DRAIN_TIMEOUT = 30 * time.Second
+
+	// How long to wait for handlers to unwind after force-closing their
+	// client connections
+	SHUTDOWN_FORCE_WAIT = 5 * time.Second
+
+	// Process exit codes, so systemd can tell a clean drain from a cut one
+	EXIT_OK            = 0
+	EXIT_FAILURE       = 1
+	EXIT_DRAIN_TIMEOUT = 2
+)
+
+// ErrDrainTimeout is returned by Shutdown when sessions were still running at
+// the drain deadline and had to be closed
+var ErrDrainTimeout = errors.New("drain deadline exceeded, remaining connections were closed")
+
+// trackConn registers a client connection as in flight until untrackConn
+func (s *ProxyServer) trackConn(conn net.Conn) {
+	s.activeMutex.Lock()
+	s.active[conn] = struct{}{}
+	s.activeMutex.Unlock()
+	s.sessions.Add(1)
+}
+
+// untrackConn marks a client connection as finished
+func (s *ProxyServer) untrackConn(conn net.Conn) {
+	s.activeMutex.Lock()
+	delete(s.active, conn)
+	s.activeMutex.Unlock()
+	s.sessions.Done()
+}
+
+// ActiveConnections returns the number of client connections in flight
+func (s *ProxyServer) ActiveConnections() int {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	return len(s.active)
+}
+
+// closeActive force-closes every client connection still in flight and
+// returns how many there were
+func (s *ProxyServer) closeActive() int {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	for conn := range s.active {
+		conn.Close()
+	}
+	return len(s.active)
+}
+
+// startDrain closes the keep-alive connections waiting for their next
+// request, and makes the others close instead of waiting once their current
+// request is done. Pending BIND requests stop waiting for their peer.
+func (s *ProxyServer) startDrain() {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	close(s.draining)
+	for conn := range s.idle {
+		conn.Close()
+	}
+	clear(s.idle)
+}
+
+// markIdle records that conn is waiting for another request. It reports
+// false when the server is draining and the connection should be closed
+// instead.
+func (s *ProxyServer) markIdle(conn net.Conn) bool {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	select {
+	case <-s.draining:
+		return false
+	default:
+	}
+	s.idle[conn] = struct{}{}
+	return true
+}
+
+// markBusy records that conn received a request. It reports false when the
+// connection was closed by startDrain while it was idle.
+func (s *ProxyServer) markBusy(conn net.Conn) bool {
+	s.activeMutex.Lock()
+	defer s.activeMutex.Unlock()
+	if _, ok := s.idle[conn]; !ok {
+		return false
+	}
+	delete(s.idle, conn)
+	return true
+}
+
+// Shutdown drains the server after Start has returned. In-flight sessions may
+// finish on their own until ctx is done; the rest are then closed. Pooled
+// upstream connections and the database are released either way. It returns
+// ErrDrainTimeout when sessions had to be cut.
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		closed := s.closeActive()
+		s.Logger.Warn("Drain deadline reached, closing remaining connections", "connections", closed)
+		err = ErrDrainTimeout
+
+		// Handlers exit once their client connection is gone, but do not
+		// hang on one that is stuck elsewhere
+		select {
+		case <-drained:
+		case <-time.After(SHUTDOWN_FORCE_WAIT):
+			s.Logger.Warn("Handlers still running after force close", "connections", s.ActiveConnections())
+		}
+	}
+
+	s.runtime().httpTransport.CloseIdleConnections()
+	// Save the sessions and traffic counted since the last batch
+	s.sessionLog.Close()
+	if logErr := s.accessLog.Close(); logErr != nil {
+		s.Logger.Error("Failed to close access log", "error", logErr)
+	}
+	if quotaErr := s.quota.flush(s.DB); quotaErr != nil {
+		s.Logger.Error("Failed to save traffic quotas", "error", quotaErr)
+	}
+	if dbErr := s.DB.Close(); dbErr != nil {
+		s.Logger.Error("Failed to close database", "error", dbErr)
+	}
+	return err
+}
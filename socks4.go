@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SOCKS4 protocol constants
+	SOCKS4_VERSION       = 0x04
+	SOCKS4_REPLY_VERSION = 0x00
+
+	// SOCKS4 reply codes
+	SOCKS4_GRANTED        = 0x5A // 90: request granted
+	SOCKS4_REJECTED       = 0x5B // 91: request rejected or failed
+	SOCKS4_USERID_INVALID = 0x5D // 93: client and identd user-ids differ
+
+	// Maximum length of the null-terminated USERID and SOCKS4a host fields
+	SOCKS4_MAX_FIELD_LENGTH = 255
+
+	// Default separator between username and password in the USERID field
+	SOCKS4_USERID_SEPARATOR = ":"
+)
+
+// handleSocks4 processes a SOCKS4 or SOCKS4a request:
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//
+// SOCKS4 has no authentication phase, so credentials are carried in USERID as
+// "<username><separator><password>" and checked against the same user table
+// and maxConnection limits as SOCKS5. On listeners that allow anonymous
+// access a USERID without credentials proceeds with no user. A DSTIP of
+// 0.0.0.x with x != 0 marks a SOCKS4a request whose hostname follows USERID.
+func (s *ProxyServer) handleSocks4(conn *bufferedConn, l *listenerSettings) error {
+	rt := s.runtime()
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	command := buf[1]
+	dstPort := binary.BigEndian.Uint16(buf[2:4])
+	dstIP := net.IP(buf[4:8])
+
+	userID, err := readNullTerminated(conn.reader)
+	if err != nil {
+		return err
+	}
+
+	// SOCKS4a: the destination is a hostname sent after USERID
+	dstAddr := dstIP.String()
+	if dstIP[0] == 0 && dstIP[1] == 0 && dstIP[2] == 0 && dstIP[3] != 0 {
+		if dstAddr, err = readNullTerminated(conn.reader); err != nil {
+			return err
+		}
+		dstIP = nil
+	}
+
+	// The request is complete, the handshake deadline no longer applies
+	conn.SetDeadline(time.Time{})
+
+	reply := func(replyCode byte, bindAddr *net.TCPAddr) error {
+		return s.sendSocks4Reply(conn, replyCode, bindAddr)
+	}
+
+	if command != CONNECT && command != BIND {
+		reply(COMMAND_NOT_SUPPORTED, nil)
+		return fmt.Errorf("unsupported SOCKS4 command: %d", command)
+	}
+
+	// Authenticate the USERID field
+	user := s.connectionUser(conn)
+	username, password, ok := strings.Cut(userID, rt.Config.Proxy.Socks4Separator)
+	switch {
+	case user != nil:
+		// Authenticated by the client certificate
+	case l.allows(AUTH_NONE) && (!ok || !l.allows(AUTH_PASSWORD)):
+		// Anonymous access
+	case !ok:
+		s.writeSocks4Reply(conn, SOCKS4_USERID_INVALID, nil)
+		return errors.New("SOCKS4 USERID does not contain credentials")
+	default:
+		if user, err = s.authenticate(conn, username, password); err != nil {
+			s.writeSocks4Reply(conn, socks4ReplyForAuthError(err), nil)
+			return err
+		}
+	}
+
+	// SOCKS4a hostnames are resolved by the proxy, or by the last parent
+	// proxy of a chain
+	var dstIPs []net.IP
+	if dstIP != nil {
+		dstIPs = append(dstIPs, dstIP)
+	}
+	if dstIP == nil && !rt.Dialer.UsesChain() {
+		ips, err := rt.Resolver.LookupIP(context.Background(), dstAddr)
+		if err != nil || len(ips) == 0 {
+			reply(HOST_UNREACHABLE, nil)
+			if command == CONNECT {
+				s.rejectSession(s.newSession(conn, dstAddr, int(dstPort)), HOST_UNREACHABLE)
+			}
+			return fmt.Errorf("failed to resolve domain %s: %v", dstAddr, err)
+		}
+		dstIPs = ips
+		dstIP = ips[0]
+	}
+
+	if command == BIND {
+		return s.handleBind(conn, rt, dstIP, dstPort, reply)
+	}
+
+	session := s.newSession(conn, dstAddr, int(dstPort))
+	if err := s.checkDestination(user, dstAddr, dstIPs, int(dstPort)); err != nil {
+		reply(CONNECTION_NOT_ALLOWED, nil)
+		s.rejectSession(session, CONNECTION_NOT_ALLOWED)
+		return err
+	}
+
+	dstAddrPort := net.JoinHostPort(dstAddr, strconv.Itoa(int(dstPort)))
+	dstConn, err := rt.Dialer.Dial(context.Background(), dstAddr, dstIPs, int(dstPort), l.egressFor(user))
+	if err != nil {
+		s.Logger.Error("Failed to connect to destination", "address", dstAddrPort, "error", err)
+		replyCode := replyCodeForDialError(err)
+		reply(replyCode, nil)
+		s.rejectSession(session, replyCode)
+		return err
+	}
+	defer dstConn.Close()
+	session.ResolvedIP = connectedIP(rt, dstConn)
+
+	if err := reply(SUCCEEDED, dstConn.LocalAddr().(*net.TCPAddr)); err != nil {
+		return err
+	}
+
+	s.proxyData(conn, dstConn, session)
+	return nil
+}
+
+// sendSocks4Reply sends a SOCKS4 reply for a SOCKS5 reply code. SOCKS4 only
+// distinguishes granted from rejected, so every failure maps to 91.
+func (s *ProxyServer) sendSocks4Reply(conn net.Conn, replyCode byte, bindAddr *net.TCPAddr) error {
+	var status byte = SOCKS4_REJECTED
+	if replyCode == SUCCEEDED {
+		status = SOCKS4_GRANTED
+	}
+	return s.writeSocks4Reply(conn, status, bindAddr)
+}
+
+// socks4ReplyForAuthError maps an authenticate error to a SOCKS4 status. Only
+// wrong credentials are reported as an invalid USERID; a login refused for a
+// connection limit, an exhausted quota, a ban or a database failure is a
+// plain rejection.
+func socks4ReplyForAuthError(err error) byte {
+	switch {
+	case errors.Is(err, ErrMaxConnections), errors.Is(err, ErrQuotaExceeded),
+		errors.Is(err, ErrBanned), errors.Is(err, ErrAuthUnavailable):
+		return SOCKS4_REJECTED
+	default:
+		return SOCKS4_USERID_INVALID
+	}
+}
+
+// writeSocks4Reply writes a raw SOCKS4 reply. Only IPv4 addresses can be
+// represented, anything else is reported as 0.0.0.0.
+func (s *ProxyServer) writeSocks4Reply(conn net.Conn, status byte, bindAddr *net.TCPAddr) error {
+	response := make([]byte, 8)
+	response[0] = SOCKS4_REPLY_VERSION
+	response[1] = status
+
+	if bindAddr != nil {
+		binary.BigEndian.PutUint16(response[2:4], uint16(bindAddr.Port))
+		if ip4 := bindAddr.IP.To4(); ip4 != nil {
+			copy(response[4:8], ip4)
+		}
+	}
+
+	s.metrics.reply(PROTOCOL_SOCKS4, status)
+	_, err := conn.Write(response)
+	return err
+}
+
+// readNullTerminated reads a NUL-terminated SOCKS4 string field
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x00 {
+			return sb.String(), nil
+		}
+		if sb.Len() >= SOCKS4_MAX_FIELD_LENGTH {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		sb.WriteByte(b)
+	}
+}
@@ -4,6 +4,15 @@ CREATE TABLE IF NOT EXISTS `user` (
   `username` VARCHAR(50) NOT NULL,
   `password` VARCHAR(32) NOT NULL COMMENT 'Mật khẩu được mã hóa bằng MD5',
   `maxConnection` INT NOT NULL DEFAULT 5 COMMENT 'Số lượng kết nối tối đa cho phép',
+  `egressIP` VARCHAR(1024) NULL DEFAULT NULL COMMENT 'Danh sách IP nguồn cho kết nối ra ngoài, phân tách bằng dấu phẩy',
+  `egressMode` VARCHAR(16) NOT NULL DEFAULT 'round-robin' COMMENT 'Cách chọn IP nguồn: round-robin hoặc random',
+  `uploadRate` BIGINT NOT NULL DEFAULT 0 COMMENT 'Băng thông tải lên (byte/giây) chia sẻ giữa mọi phiên, 0 là không giới hạn',
+  `downloadRate` BIGINT NOT NULL DEFAULT 0 COMMENT 'Băng thông tải xuống (byte/giây) chia sẻ giữa mọi phiên, 0 là không giới hạn',
+  `bytesAllowed` BIGINT NOT NULL DEFAULT 0 COMMENT 'Hạn mức lưu lượng mỗi kỳ (byte), 0 là không giới hạn',
+  `bytesUsed` BIGINT NOT NULL DEFAULT 0 COMMENT 'Lưu lượng đã dùng trong kỳ hiện tại (byte)',
+  `quotaPeriod` ENUM('daily', 'monthly', 'never') NOT NULL DEFAULT 'monthly' COMMENT 'Chu kỳ đặt lại bytesUsed',
+  `quotaResetAt` DATETIME NULL DEFAULT NULL COMMENT 'Thời điểm bắt đầu kỳ hiện tại (UTC)',
+  `maxSessionSeconds` INT NOT NULL DEFAULT 0 COMMENT 'Thời gian sống tối đa của mỗi phiên (giây), 0 là dùng proxy.maxSessionDuration',
   `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `updatedAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   PRIMARY KEY (`username`)
@@ -11,4 +20,70 @@ CREATE TABLE IF NOT EXISTS `user` (
 
 -- Thêm một số dữ liệu mẫu
 INSERT INTO `user` (`username`, `password`, `maxConnection`) VALUES
-('admin', MD5('Tuandev2001'), 1);
\ No newline at end of file
+('admin', MD5('Tuandev2001'), 1);
+
+-- Nhóm người dùng, dùng cho quy tắc truy cập theo nhóm
+CREATE TABLE IF NOT EXISTS `userGroup` (
+  `username` VARCHAR(50) NOT NULL,
+  `groupName` VARCHAR(50) NOT NULL,
+  PRIMARY KEY (`username`, `groupName`),
+  CONSTRAINT `fk_userGroup_user` FOREIGN KEY (`username`) REFERENCES `user` (`username`) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Quy tắc truy cập đích, đánh giá theo priority rồi id, quy tắc khớp đầu tiên được áp dụng
+CREATE TABLE IF NOT EXISTS `aclRule` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `priority` INT NOT NULL DEFAULT 100 COMMENT 'Nhỏ hơn được đánh giá trước',
+  `scope` ENUM('global', 'user', 'group') NOT NULL DEFAULT 'global',
+  `subject` VARCHAR(50) NULL DEFAULT NULL COMMENT 'Username hoặc tên nhóm, NULL với quy tắc global',
+  `action` ENUM('allow', 'deny') NOT NULL,
+  `destination` VARCHAR(255) NOT NULL DEFAULT '*' COMMENT '*, CIDR, IP, tên miền hoặc *.tên miền',
+  `portFrom` INT NULL DEFAULT NULL COMMENT 'Cổng đầu, NULL là mọi cổng',
+  `portTo` INT NULL DEFAULT NULL COMMENT 'Cổng cuối, NULL là chỉ portFrom',
+  `enabled` TINYINT(1) NOT NULL DEFAULT 1,
+  `description` VARCHAR(255) NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updatedAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_aclRule_priority` (`priority`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Lịch sử phiên: mỗi tunnel (SOCKS5/SOCKS4 CONNECT, BIND, HTTP CONNECT, UDP ASSOCIATE), mỗi yêu cầu HTTP forward và mỗi yêu cầu bị từ chối, thời gian theo UTC
+CREATE TABLE IF NOT EXISTS `session` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `username` VARCHAR(50) NULL DEFAULT NULL COMMENT 'NULL với kết nối ẩn danh',
+  `clientAddr` VARCHAR(255) NOT NULL,
+  `host` VARCHAR(255) NOT NULL COMMENT 'Đích client yêu cầu: tên miền hoặc IP',
+  `port` INT NOT NULL,
+  `resolvedIP` VARCHAR(45) NULL DEFAULT NULL COMMENT 'IP thực sự được kết nối, NULL khi đi qua proxy cha hoặc chưa kết nối',
+  `startedAt` DATETIME(3) NOT NULL,
+  `endedAt` DATETIME(3) NOT NULL,
+  `bytesUp` BIGINT NOT NULL DEFAULT 0 COMMENT 'Client đến đích',
+  `bytesDown` BIGINT NOT NULL DEFAULT 0 COMMENT 'Đích đến client',
+  `replyCode` TINYINT UNSIGNED NOT NULL COMMENT 'Mã trả lời SOCKS5, 0 là thành công',
+  `closeReason` VARCHAR(16) NOT NULL COMMENT 'client, target, error, quota, idle, lifetime hoặc rejected',
+  PRIMARY KEY (`id`),
+  KEY `idx_session_username` (`username`, `startedAt`),
+  KEY `idx_session_startedAt` (`startedAt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Nâng cấp bảng user đã tồn tại để hỗ trợ IP nguồn riêng cho từng người dùng
+-- ALTER TABLE `user`
+--   ADD COLUMN `egressIP` VARCHAR(1024) NULL DEFAULT NULL COMMENT 'Danh sách IP nguồn cho kết nối ra ngoài, phân tách bằng dấu phẩy' AFTER `maxConnection`,
+--   ADD COLUMN `egressMode` VARCHAR(16) NOT NULL DEFAULT 'round-robin' COMMENT 'Cách chọn IP nguồn: round-robin hoặc random' AFTER `egressIP`;
+
+-- Nâng cấp bảng user đã tồn tại để hỗ trợ giới hạn băng thông theo người dùng
+-- ALTER TABLE `user`
+--   ADD COLUMN `uploadRate` BIGINT NOT NULL DEFAULT 0 COMMENT 'Băng thông tải lên (byte/giây) chia sẻ giữa mọi phiên, 0 là không giới hạn' AFTER `egressMode`,
+--   ADD COLUMN `downloadRate` BIGINT NOT NULL DEFAULT 0 COMMENT 'Băng thông tải xuống (byte/giây) chia sẻ giữa mọi phiên, 0 là không giới hạn' AFTER `uploadRate`;
+
+-- Nâng cấp bảng user đã tồn tại để hỗ trợ hạn mức lưu lượng
+-- ALTER TABLE `user`
+--   ADD COLUMN `bytesAllowed` BIGINT NOT NULL DEFAULT 0 COMMENT 'Hạn mức lưu lượng mỗi kỳ (byte), 0 là không giới hạn' AFTER `downloadRate`,
+--   ADD COLUMN `bytesUsed` BIGINT NOT NULL DEFAULT 0 COMMENT 'Lưu lượng đã dùng trong kỳ hiện tại (byte)' AFTER `bytesAllowed`,
+--   ADD COLUMN `quotaPeriod` ENUM('daily', 'monthly', 'never') NOT NULL DEFAULT 'monthly' COMMENT 'Chu kỳ đặt lại bytesUsed' AFTER `bytesUsed`,
+--   ADD COLUMN `quotaResetAt` DATETIME NULL DEFAULT NULL COMMENT 'Thời điểm bắt đầu kỳ hiện tại (UTC)' AFTER `quotaPeriod`;
+
+-- Nâng cấp bảng user đã tồn tại để hỗ trợ thời gian sống tối đa của phiên
+-- ALTER TABLE `user`
+--   ADD COLUMN `maxSessionSeconds` INT NOT NULL DEFAULT 0 COMMENT 'Thời gian sống tối đa của mỗi phiên (giây), 0 là dùng proxy.maxSessionDuration' AFTER `quotaResetAt`;
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Deadline for a client to complete the TLS handshake
+	TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// How often the certificate files are checked for changes. The check
+	// runs during handshakes, so an idle listener does not touch the disk.
+	TLS_CERT_CHECK_INTERVAL = 5 * time.Second
+)
+
+// ListenerTLSConfig wraps a listener in TLS. The proxy protocols run
+// unchanged inside the TLS session, so RFC 1929 credentials are encrypted.
+type ListenerTLSConfig struct {
+	CertFile   string   `yaml:"certFile"`   // PEM certificate chain
+	KeyFile    string   `yaml:"keyFile"`    // PEM private key
+	MinVersion string   `yaml:"minVersion"` // "1.2" or "1.3", empty for 1.3
+	ALPN       []string `yaml:"alpn"`       // Protocols offered in ALPN, empty for none
+
+	// Client certificates, used by the certificate auth method
+	ClientCAFile string `yaml:"clientCAFile"` // PEM bundle of CAs issuing client certificates
+	CRLFile      string `yaml:"crlFile"`      // Revoked client certificates, PEM or DER
+	CertUser     string `yaml:"certUser"`     // "cn" or "san", empty for cn
+}
+
+// parseListenerTLS builds the server TLS config of a listener. The
+// certificate is loaded now so a bad file is reported by Validate. With the
+// certificate auth method, client certificates are verified against the
+// client CA bundle and CRL; they are required unless other methods remain.
+func parseListenerTLS(c *ListenerTLSConfig, authMethods map[string]bool) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("tls.certFile and tls.keyFile are required")
+	}
+
+	var minVersion uint16
+	switch c.MinVersion {
+	case "", "1.3":
+		minVersion = tls.VersionTLS13
+	case "1.2":
+		minVersion = tls.VersionTLS12
+	default:
+		return nil, fmt.Errorf("unsupported tls.minVersion %q, use 1.2 or 1.3", c.MinVersion)
+	}
+
+	certs, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     c.ALPN,
+	}
+
+	if !authMethods[AUTH_CERTIFICATE] {
+		if c.ClientCAFile != "" || c.CRLFile != "" || c.CertUser != "" {
+			return nil, fmt.Errorf("client certificate settings require the %s auth method", AUTH_CERTIFICATE)
+		}
+		return config, nil
+	}
+
+	if c.ClientCAFile == "" {
+		return nil, fmt.Errorf("the %s auth method requires tls.clientCAFile", AUTH_CERTIFICATE)
+	}
+	switch c.CertUser {
+	case "", CERT_USER_CN, CERT_USER_SAN:
+	default:
+		return nil, fmt.Errorf("unknown tls.certUser %q, use %s or %s", c.CertUser, CERT_USER_CN, CERT_USER_SAN)
+	}
+
+	pool, cas, err := loadCABundle(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if len(authMethods) == 1 {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if c.CRLFile != "" {
+		crl, err := newRevocationList(c.CRLFile, cas)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				if err := crl.check(chain); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// certReloader serves a certificate and key pair from disk and picks up new
+// files when they change, so renewed certificates apply without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Newest modification time of the loaded files
+	checked time.Time // Last time the files were checked
+}
+
+// newCertReloader loads the certificate and key files
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key pair. The caller must hold mutex once
+// the reloader is in use.
+func (r *certReloader) load() error {
+	modTime, err := newestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// newestModTime returns the newest modification time of the files
+func newestModTime(paths ...string) (time.Time, error) {
+	var newest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate that
+// fails to load, e.g. because the key is not written yet, is retried on the
+// next check while the current one stays in use.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) >= TLS_CERT_CHECK_INTERVAL {
+		r.checked = time.Now()
+		modTime, err := newestModTime(r.certFile, r.keyFile)
+		if err == nil && !modTime.Equal(r.modTime) {
+			err = r.load()
+			if err == nil {
+				slog.Info("TLS certificate reloaded", "cert", r.certFile)
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed to reload TLS certificate, keeping the current one", "cert", r.certFile, "error", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// handshakeTLS completes the TLS handshake of a client connection and logs
+// what was negotiated
+func (s *ProxyServer) handshakeTLS(conn *tls.Conn, l *listenerSettings) error {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	s.Logger.Info("TLS handshake completed", "client", conn.RemoteAddr().String(), "listener", l.Name,
+		"version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite),
+		"alpn", state.NegotiatedProtocol, "sni", state.ServerName)
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Largest UDP payload we relay in either direction
+	UDP_BUFFER_SIZE = 64 * 1024
+
+	// Most destinations an association accepts replies from. Once full, the
+	// one the client sent to least recently is forgotten.
+	UDP_MAX_TARGETS = 1024
+
+	// How long replies from a destination are accepted after the client last
+	// sent to it
+	UDP_TARGET_TTL = 5 * time.Minute
+)
+
+// udpRequest is a parsed RFC 1928 UDP request header and its payload
+type udpRequest struct {
+	Frag    byte
+	Host    string
+	Port    uint16
+	Payload []byte
+}
+
+// parseUDPRequest parses the header that prefixes every datagram sent by the
+// client to the relay:
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+func parseUDPRequest(b []byte) (*udpRequest, error) {
+	if len(b) < 4 {
+		return nil, errors.New("UDP request too short")
+	}
+
+	req := &udpRequest{Frag: b[2]}
+	addrType := b[3]
+	pos := 4
+
+	switch addrType {
+	case IPV4_ADDRESS:
+		if len(b) < pos+net.IPv4len+2 {
+			return nil, errors.New("UDP request too short for IPv4 address")
+		}
+		req.Host = net.IP(b[pos : pos+net.IPv4len]).String()
+		pos += net.IPv4len
+
+	case IPV6_ADDRESS:
+		if len(b) < pos+net.IPv6len+2 {
+			return nil, errors.New("UDP request too short for IPv6 address")
+		}
+		req.Host = net.IP(b[pos : pos+net.IPv6len]).String()
+		pos += net.IPv6len
+
+	case DOMAIN_ADDRESS:
+		if len(b) < pos+1 {
+			return nil, errors.New("UDP request too short for domain length")
+		}
+		addrLen := int(b[pos])
+		pos++
+		if len(b) < pos+addrLen+2 {
+			return nil, errors.New("UDP request too short for domain")
+		}
+		req.Host = string(b[pos : pos+addrLen])
+		pos += addrLen
+
+	default:
+		return nil, fmt.Errorf("unsupported address type: %d", addrType)
+	}
+
+	req.Port = binary.BigEndian.Uint16(b[pos : pos+2])
+	req.Payload = b[pos+2:]
+	return req, nil
+}
+
+// buildUDPHeader builds the header prepended to datagrams relayed back to the
+// client. Replies are never fragmented, so FRAG is always zero.
+func buildUDPHeader(addr *net.UDPAddr) []byte {
+	header := make([]byte, 0, 22) // Max size for IPv6
+	header = append(header, 0x00, 0x00, 0x00)
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		header = append(header, IPV4_ADDRESS)
+		header = append(header, ip4...)
+	} else {
+		header = append(header, IPV6_ADDRESS)
+		header = append(header, addr.IP.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(header, uint16(addr.Port))
+}
+
+// handleUDPAssociate processes a SOCKS5 UDP ASSOCIATE request.
+//
+// Each association gets its own relay socket facing the client and its own
+// outbound socket facing destinations. Only datagrams from the IP that
+// authenticated on the control connection are relayed, and the association
+// lives as long as that TCP connection: it keeps the connection slot taken
+// in performAuth and is torn down as soon as the client disconnects, or once
+// no datagram was relayed for proxy.idleTimeout.
+// It is refused behind a parent proxy chain, which only carries TCP, so that
+// datagrams never leave from the proxy's own address.
+func (s *ProxyServer) handleUDPAssociate(conn net.Conn, rt *runtimeConfig, l *listenerSettings, dstIP net.IP, dstPort uint16) error {
+	if rt.Dialer.UsesChain() {
+		s.sendReply(conn, COMMAND_NOT_SUPPORTED, nil)
+		return errors.New("UDP ASSOCIATE is not supported through upstream proxies")
+	}
+
+	// Datagrams are matched to the client by IP, which unix sockets lack
+	clientTCPAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		s.sendReply(conn, COMMAND_NOT_SUPPORTED, nil)
+		return fmt.Errorf("UDP ASSOCIATE is not supported on %s listeners", l.Network)
+	}
+	clientIP := clientTCPAddr.IP
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+
+	// A non-zero DST.ADDR in the request pins the client's source address
+	if dstIP != nil && !dstIP.IsUnspecified() && !dstIP.Equal(clientIP) {
+		s.sendReply(conn, CONNECTION_NOT_ALLOWED, nil)
+		return fmt.Errorf("UDP ASSOCIATE address %s does not match client %s", dstIP, clientIP)
+	}
+
+	// Client-facing relay socket on the interface the client reached us on
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP, Port: 0})
+	if err != nil {
+		s.sendReply(conn, GENERAL_FAILURE, nil)
+		return fmt.Errorf("failed to open UDP relay: %v", err)
+	}
+	defer relayConn.Close()
+
+	// Destination-facing socket, bound to the egress address if any
+	var outAddr *net.UDPAddr
+	user := s.connectionUser(conn)
+	if egress := l.egressFor(user); egress != nil {
+		outAddr = &net.UDPAddr{IP: egress.PickAny()}
+	}
+	outConn, err := net.ListenUDP("udp", outAddr)
+	if err != nil {
+		s.sendReply(conn, GENERAL_FAILURE, nil)
+		return fmt.Errorf("failed to open UDP outbound socket: %v", err)
+	}
+	defer outConn.Close()
+
+	// Datagrams count against the same shared limits as TCP sessions
+	upload := []*rate.Limiter{s.bandwidth.GlobalUpload}
+	download := []*rate.Limiter{s.bandwidth.GlobalDownload}
+	if bandwidth := s.bandwidth.acquire(user); bandwidth != nil {
+		defer s.bandwidth.release(user)
+		upload = append(upload, bandwidth.Upload)
+		download = append(download, bandwidth.Download)
+	}
+	s.quota.acquire(user)
+	defer s.quota.release(user)
+
+	// The session names the client address given in the request, there is
+	// no single destination
+	var host string
+	if dstIP != nil {
+		host = dstIP.String()
+	}
+	record := s.newSession(conn, host, int(dstPort))
+	sessionOf(conn).setState(SESSION_STATE_ACTIVE)
+
+	relayAddr := relayConn.LocalAddr().(*net.UDPAddr)
+	if err := s.sendReply(conn, SUCCEEDED, &net.TCPAddr{IP: relayAddr.IP, Port: relayAddr.Port}); err != nil {
+		return err
+	}
+
+	bytesUp, bytesDown := s.metrics.traffic(user)
+	assoc := &udpAssociation{
+		server:      s,
+		resolver:    rt.Resolver,
+		user:        user,
+		session:     sessionOf(conn),
+		record:      record,
+		relayConn:   relayConn,
+		outConn:     outConn,
+		clientIP:    clientIP,
+		clientPort:  int(dstPort),
+		upload:      upload,
+		download:    download,
+		bytesUp:     bytesUp,
+		bytesDown:   bytesDown,
+		idleTimeout: rt.Config.Proxy.IdleTimeout,
+		targets:     make(map[string]time.Time),
+	}
+	assoc.lastActive.Store(time.Now().UnixNano())
+
+	// The association ends with the session lifetime like a TCP tunnel
+	if lifetime := sessionLifetime(rt, user); lifetime > 0 {
+		timer := time.AfterFunc(lifetime, func() { assoc.close(SESSION_CLOSE_LIFETIME) })
+		defer timer.Stop()
+	}
+
+	// Tear the relay down when the controlling TCP connection closes
+	go func() {
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			assoc.close(SESSION_CLOSE_ERROR)
+		} else {
+			assoc.close(SESSION_CLOSE_CLIENT)
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer assoc.close(SESSION_CLOSE_ERROR)
+		assoc.relayFromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		defer assoc.close(SESSION_CLOSE_ERROR)
+		assoc.relayToClient()
+	}()
+	wg.Wait()
+
+	record.ReplyCode = SUCCEEDED
+	record.EndedAt = time.Now()
+	s.finishSession(record)
+	return nil
+}
+
+// udpAssociation holds the state of a single UDP ASSOCIATE session
+type udpAssociation struct {
+	server     *ProxyServer
+	resolver   Resolver
+	user       *User
+	session    *LiveSession
+	record     *Session // Finished when the association ends
+	relayConn  *net.UDPConn
+	outConn    *net.UDPConn
+	clientIP   net.IP
+	clientPort int             // Source port announced by the client, 0 if unknown
+	upload     []*rate.Limiter // Bandwidth limits of client to destination datagrams
+	download   []*rate.Limiter // Bandwidth limits of destination to client datagrams
+	bytesUp    prometheus.Counter
+	bytesDown  prometheus.Counter
+
+	idleTimeout time.Duration // Time without datagrams that ends the association, 0 for no limit
+	lastActive  atomic.Int64  // Unix nanoseconds of the last datagram relayed
+	closeOnce   sync.Once
+
+	mutex      sync.RWMutex
+	clientAddr *net.UDPAddr         // Source address of the client's datagrams
+	targets    map[string]time.Time // Destinations the client has sent to, and when it last did
+}
+
+// close tears the association down by closing both sockets, which ends both
+// relay goroutines, and records why it ended. It reports whether this call
+// closed it.
+func (a *udpAssociation) close(reason string) bool {
+	closed := false
+	a.closeOnce.Do(func() {
+		closed = true
+		a.record.CloseReason = reason
+		a.relayConn.Close()
+		a.outConn.Close()
+	})
+	return closed
+}
+
+// expired handles a read deadline that passed. It reports whether the
+// association has been idle for idleTimeout, rather than quiet in one
+// direction while the other carried datagrams, and closes it if so.
+func (a *udpAssociation) expired() bool {
+	if !idleSince(&a.lastActive, a.idleTimeout) {
+		return false
+	}
+	if a.close(SESSION_CLOSE_IDLE) {
+		a.server.Logger.Info("Closing idle UDP association", "client", a.clientIP, "timeout", a.idleTimeout)
+	}
+	return true
+}
+
+// remember records that the client sent to target, so that its replies are
+// relayed. The caller must hold mutex.
+func (a *udpAssociation) remember(target string, now time.Time) {
+	if _, ok := a.targets[target]; !ok && len(a.targets) >= UDP_MAX_TARGETS {
+		oldest := ""
+		for key, last := range a.targets {
+			if now.Sub(last) >= UDP_TARGET_TTL {
+				delete(a.targets, key)
+			} else if oldest == "" || last.Before(a.targets[oldest]) {
+				oldest = key
+			}
+		}
+		if len(a.targets) >= UDP_MAX_TARGETS {
+			delete(a.targets, oldest)
+		}
+	}
+	a.targets[target] = now
+}
+
+// known reports whether replies from target are relayed. The caller must
+// hold mutex.
+func (a *udpAssociation) known(target string, now time.Time) bool {
+	last, ok := a.targets[target]
+	return ok && now.Sub(last) < UDP_TARGET_TTL
+}
+
+// relayFromClient forwards datagrams from the client to their destinations
+func (a *udpAssociation) relayFromClient() {
+	buf := make([]byte, UDP_BUFFER_SIZE)
+	for {
+		a.relayConn.SetReadDeadline(idleDeadline(a.idleTimeout))
+		n, srcAddr, err := a.relayConn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !a.expired() {
+				continue
+			}
+			return
+		}
+
+		// Drop datagrams that do not come from the authenticated client
+		if !srcAddr.IP.Equal(a.clientIP) || (a.clientPort != 0 && srcAddr.Port != a.clientPort) {
+			continue
+		}
+
+		req, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			a.server.Logger.Debug("Dropping malformed UDP request", "client", srcAddr, "error", err)
+			continue
+		}
+
+		// Fragmentation is not supported, so fragments must be dropped
+		if req.Frag != 0x00 {
+			continue
+		}
+
+		dstIP := net.ParseIP(req.Host)
+		if dstIP == nil {
+			ips, err := a.resolver.LookupIP(context.Background(), req.Host)
+			if err != nil || len(ips) == 0 {
+				a.server.Logger.Debug("Failed to resolve UDP destination", "host", req.Host, "error", err)
+				continue
+			}
+			dstIP = ips[0]
+		}
+
+		// Datagrams to denied destinations are dropped
+		if err := a.server.checkDestination(a.user, req.Host, []net.IP{dstIP}, int(req.Port)); err != nil {
+			continue
+		}
+		dstAddr := &net.UDPAddr{IP: dstIP, Port: int(req.Port)}
+
+		a.mutex.Lock()
+		a.clientAddr = srcAddr
+		a.remember(dstAddr.String(), time.Now())
+		a.mutex.Unlock()
+
+		// Datagrams over the bandwidth limit are dropped, not queued
+		if !allowBandwidth(a.upload, len(req.Payload)) {
+			continue
+		}
+		// The association ends when the quota runs out
+		if !a.server.quota.consume(a.user, len(req.Payload)) {
+			a.server.Logger.Warn("Traffic quota exhausted, closing UDP association", "username", a.user.Username)
+			a.close(SESSION_CLOSE_QUOTA)
+			return
+		}
+
+		a.session.addTraffic(int64(len(req.Payload)), 0)
+		a.bytesUp.Add(float64(len(req.Payload)))
+		if _, err := a.outConn.WriteToUDP(req.Payload, dstAddr); err != nil {
+			a.server.Logger.Debug("UDP write error", "direction", "client->target", "error", err)
+			continue
+		}
+		a.lastActive.Store(time.Now().UnixNano())
+		a.record.BytesUp += int64(len(req.Payload))
+	}
+}
+
+// relayToClient forwards replies from destinations back to the client
+func (a *udpAssociation) relayToClient() {
+	buf := make([]byte, UDP_BUFFER_SIZE)
+	for {
+		a.outConn.SetReadDeadline(idleDeadline(a.idleTimeout))
+		n, srcAddr, err := a.outConn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !a.expired() {
+				continue
+			}
+			return
+		}
+
+		a.mutex.RLock()
+		clientAddr := a.clientAddr
+		known := a.known(srcAddr.String(), time.Now())
+		a.mutex.RUnlock()
+
+		// Only relay replies from hosts the client has talked to
+		if clientAddr == nil || !known {
+			continue
+		}
+
+		if !allowBandwidth(a.download, n) {
+			continue
+		}
+		if !a.server.quota.consume(a.user, n) {
+			a.server.Logger.Warn("Traffic quota exhausted, closing UDP association", "username", a.user.Username)
+			a.close(SESSION_CLOSE_QUOTA)
+			return
+		}
+
+		a.session.addTraffic(0, int64(n))
+		a.bytesDown.Add(float64(n))
+		packet := append(buildUDPHeader(srcAddr), buf[:n]...)
+		if _, err := a.relayConn.WriteToUDP(packet, clientAddr); err != nil {
+			a.server.Logger.Debug("UDP write error", "direction", "target->client", "error", err)
+			continue
+		}
+		a.lastActive.Store(time.Now().UnixNano())
+		a.record.BytesDown += int64(n)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseUDPRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram []byte
+		frag     byte
+		host     string
+		port     uint16
+		payload  []byte
+		err      bool
+	}{
+		{
+			name:     "ipv4",
+			datagram: []byte{0, 0, 0, IPV4_ADDRESS, 192, 0, 2, 1, 0, 53, 'h', 'i'},
+			host:     "192.0.2.1", port: 53, payload: []byte("hi"),
+		},
+		{
+			name:     "ipv6",
+			datagram: append(append([]byte{0, 0, 0, IPV6_ADDRESS}, net.ParseIP("2001:db8::1")...), 0x01, 0xBB, 'h', 'i'),
+			host:     "2001:db8::1", port: 443, payload: []byte("hi"),
+		},
+		{
+			name:     "domain",
+			datagram: []byte{0, 0, 0, DOMAIN_ADDRESS, 3, 'a', '.', 'b', 0, 53, 'h', 'i'},
+			host:     "a.b", port: 53, payload: []byte("hi"),
+		},
+		{
+			name:     "empty payload",
+			datagram: []byte{0, 0, 0, IPV4_ADDRESS, 192, 0, 2, 1, 0, 53},
+			host:     "192.0.2.1", port: 53, payload: []byte{},
+		},
+		{
+			name:     "fragment",
+			datagram: []byte{0, 0, 1, IPV4_ADDRESS, 192, 0, 2, 1, 0, 53, 'h', 'i'},
+			frag:     1, host: "192.0.2.1", port: 53, payload: []byte("hi"),
+		},
+		{name: "empty", datagram: []byte{}, err: true},
+		{name: "no address type", datagram: []byte{0, 0, 0}, err: true},
+		{name: "short ipv4", datagram: []byte{0, 0, 0, IPV4_ADDRESS, 192, 0, 2}, err: true},
+		{name: "ipv4 without port", datagram: []byte{0, 0, 0, IPV4_ADDRESS, 192, 0, 2, 1, 0}, err: true},
+		{name: "short ipv6", datagram: append([]byte{0, 0, 0, IPV6_ADDRESS}, make([]byte, 15)...), err: true},
+		{name: "ipv6 without port", datagram: append([]byte{0, 0, 0, IPV6_ADDRESS}, make([]byte, 17)...), err: true},
+		{name: "no domain length", datagram: []byte{0, 0, 0, DOMAIN_ADDRESS}, err: true},
+		{name: "short domain", datagram: []byte{0, 0, 0, DOMAIN_ADDRESS, 10, 'a', '.', 'b'}, err: true},
+		{name: "domain without port", datagram: []byte{0, 0, 0, DOMAIN_ADDRESS, 3, 'a', '.', 'b', 0}, err: true},
+		{name: "domain length past end", datagram: []byte{0, 0, 0, DOMAIN_ADDRESS, 255, 0, 53}, err: true},
+		{name: "unsupported address type", datagram: []byte{0, 0, 0, 0x02, 192, 0, 2, 1, 0, 53}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseUDPRequest(tt.datagram)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", req)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if req.Frag != tt.frag || req.Host != tt.host || req.Port != tt.port || !bytes.Equal(req.Payload, tt.payload) {
+				t.Fatalf("got frag %d host %q port %d payload %q, want %d %q %d %q",
+					req.Frag, req.Host, req.Port, req.Payload, tt.frag, tt.host, tt.port, tt.payload)
+			}
+		})
+	}
+}
+
+func TestBuildUDPHeader(t *testing.T) {
+	tests := []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	}
+
+	for _, addr := range tests {
+		t.Run(addr.String(), func(t *testing.T) {
+			req, err := parseUDPRequest(append(buildUDPHeader(addr), 'h', 'i'))
+			if err != nil {
+				t.Fatalf("header does not parse: %v", err)
+			}
+			if req.Frag != 0 || req.Host != addr.IP.String() || int(req.Port) != addr.Port || string(req.Payload) != "hi" {
+				t.Fatalf("got %+v, want %s", req, addr)
+			}
+		})
+	}
+}
+
+func TestUDPAssociationTargets(t *testing.T) {
+	a := &udpAssociation{targets: make(map[string]time.Time)}
+	start := time.Now()
+	target := func(i int) string {
+		return net.JoinHostPort("192.0.2.1", strconv.Itoa(i))
+	}
+
+	// Filling the map, then sending to one more target forgets the one sent
+	// to least recently
+	for i := range UDP_MAX_TARGETS {
+		a.remember(target(i), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	a.remember(target(0), start.Add(UDP_MAX_TARGETS*time.Millisecond))
+	now := start.Add((UDP_MAX_TARGETS + 1) * time.Millisecond)
+	a.remember(target(UDP_MAX_TARGETS), now)
+
+	if len(a.targets) != UDP_MAX_TARGETS {
+		t.Fatalf("got %d targets, want %d", len(a.targets), UDP_MAX_TARGETS)
+	}
+	for _, tt := range []struct {
+		target string
+		want   bool
+	}{
+		{target(0), true},
+		{target(1), false},
+		{target(2), true},
+		{target(UDP_MAX_TARGETS), true},
+		{target(UDP_MAX_TARGETS + 1), false},
+	} {
+		if got := a.known(tt.target, now); got != tt.want {
+			t.Errorf("known(%s) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+
+	// Replies are no longer accepted once a target expires, and expired
+	// targets make room before anything recent is forgotten
+	later := start.Add(UDP_TARGET_TTL + 10*time.Millisecond)
+	if a.known(target(2), later) {
+		t.Errorf("known(%s) after %s, want false", target(2), UDP_TARGET_TTL)
+	}
+	a.remember(target(UDP_MAX_TARGETS+1), later)
+	if !a.known(target(UDP_MAX_TARGETS), later) || !a.known(target(0), later) {
+		t.Error("recent targets were forgotten while expired ones remained")
+	}
+	if len(a.targets) >= UDP_MAX_TARGETS {
+		t.Errorf("got %d targets, want expired ones removed", len(a.targets))
+	}
+}